@@ -1,6 +1,8 @@
 package main
 
 import (
+	"../worldlib"
+	"github.com/faiface/pixel"
 	"math/rand"
 	"time"
 )
@@ -10,70 +12,54 @@ const (
 	ShotInterval            = time.Millisecond * 1400
 	BotSpeed                = 70.0
 	TickInterval            = time.Second / 60
+	BotStartDelay           = time.Second * 3
 )
 
-func GenerateMoves() {
-	lastDirChange := Clock.GetCurrentTime()
-	lastShotFired := lastDirChange
-	lastTime := lastDirChange
-	var x, y, dt float64
-
-	time.Sleep(time.Second * 3)
-
-	last := time.Now()
-
-	for {
-		// Generate position
-		if time.Since(lastDirChange) > DirectionChangeInterval {
-			x, y = randomDir()*BotSpeed, randomDir()*BotSpeed
-			lastDirChange = Clock.GetCurrentTime()
-		}
-		dt = time.Since(lastTime).Seconds()
-		lastTime = Clock.GetCurrentTime()
-
-		update := localPlayer.Update().Timestamp(Clock.GetCurrentTime())
-		newX, newY := update.Pos.X+(x*dt), update.Pos.Y+(y*dt)
-
-		if !(newX < MinX || newX > MaxX) {
-			update.Pos.X = newX
-		}
-		if !(newY < MinY || newY > MaxY) {
-			update.Pos.Y = newY
-		}
+// Generates input for the local player in place of a keyboard and mouse
+type Bot struct {
+	started       time.Time
+	lastDirChange time.Time
+	lastShotFired time.Time
+	dir           pixel.Vec
+}
 
-		// Point shot angle at rand player
-		if time.Since(lastShotFired) > ShotInterval && len(players) >= 1 {
-			index := rand.Intn(len(players))
-			playerID, count := uint64(0), 0
-			for id := range players {
-				if count == index {
-					playerID = id
-					break
-				}
-				count++
-			}
-			if playerID != 0 {
-				update.Angle = players[playerID].Pos.Sub(update.Pos).Angle()
-			}
-		}
+func NewBot() *Bot {
+	now := Clock.GetCurrentTime()
 
-		localPlayer.Accept(update)
-		RecordUpdates <- update
+	return &Bot{
+		started:       now,
+		lastDirChange: now,
+		lastShotFired: now,
+	}
+}
 
-		//time.Sleep(time.Millisecond * 10)
+func (b *Bot) Input() worldlib.Input {
+	now := Clock.GetCurrentTime()
+	input := worldlib.Input{
+		Angle: world.Local.Angle,
+	}
 
-		if time.Since(lastShotFired) > ShotInterval && len(players) >= 1 {
-			FireBullet() // PEW PEW PEW!
-			lastShotFired = Clock.GetCurrentTime()
-		}
+	if now.Sub(b.started) < BotStartDelay {
+		// Stand still for a bit while we find some peers
+		return input
+	}
 
-		dt := time.Now().Sub(last)
-		if dt < TickInterval {
-			time.Sleep(TickInterval - dt)
-		}
+	// Generate position
+	if now.Sub(b.lastDirChange) > DirectionChangeInterval {
+		b.dir = pixel.V(randomDir()*BotSpeed, randomDir()*BotSpeed)
+		b.lastDirChange = now
+	}
+	input.Move = b.dir
 
-		last = time.Now()
+	// Point shot angle at rand player
+	if now.Sub(b.lastShotFired) > ShotInterval && len(world.PlayerIDs) >= 1 {
+		target := world.Players[world.PlayerIDs[rand.Intn(len(world.PlayerIDs))]]
+		input.Angle = target.Shown.Sub(world.Local.Pos).Angle()
+		input.Fire = true // PEW PEW PEW!
+		b.lastShotFired = now
 	}
+
+	return input
 }
 
 func randomDir() float64 {
@@ -1,39 +1,18 @@
 package main
 
 import (
+	"../worldlib"
 	"github.com/faiface/pixel"
-	"math"
 )
 
-const (
-	BulletSpeed = 200.0
-)
-
-type Bullet struct {
-	sprite   *pixel.Sprite
-	PlayerID uint64
-	Pos      pixel.Vec
-	Angle    float64
-}
+var bulletSprite *pixel.Sprite
 
-func NewBullet(playerID uint64, pos pixel.Vec, angle float64) *Bullet {
-	return &Bullet{
-		PlayerID: playerID,
-		Pos:      pos,
-		Angle:    angle,
-		sprite:   pixel.NewSprite(bulletPic, bulletPic.Bounds()),
+func DrawBullet(t pixel.Target, b *worldlib.Bullet) {
+	if bulletSprite == nil {
+		bulletSprite = pixel.NewSprite(bulletPic, bulletPic.Bounds())
 	}
-}
 
-func (b *Bullet) Draw(t pixel.Target) {
 	mat := pixel.IM.Moved(b.Pos)
 
-	b.sprite.Draw(t, mat)
-}
-
-func (b *Bullet) Update(dt float64) {
-	b.Pos = b.Pos.Add(pixel.V(
-		dt*BulletSpeed*math.Cos(b.Angle),
-		dt*BulletSpeed*math.Sin(b.Angle),
-	))
+	bulletSprite.Draw(t, mat)
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/faiface/pixel"
+	"github.com/faiface/pixel/imdraw"
+	"golang.org/x/image/colornames"
+)
+
+// The world is bigger than the window, so the window shows the part of it
+// around the local player. It stops at the edges of the world rather than show
+// what's past them.
+
+const (
+	WORLD_BORDER_WIDTH = 3.0
+)
+
+// Maps world positions to where they are on the window. Set every frame.
+var camera = pixel.IM
+
+// Centers the camera on where the local player is shown
+func updateCamera() {
+	view := win.Bounds()
+	bounds := world.Bounds
+	pos := world.Local.Shown
+
+	center := pixel.V(
+		cameraAxis(pos.X, bounds.Min.X, bounds.Max.X, view.W()/2),
+		cameraAxis(pos.Y, bounds.Min.Y, bounds.Max.Y, view.H()/2),
+	)
+
+	camera = pixel.IM.Moved(view.Center().Sub(center))
+	win.SetMatrix(camera)
+}
+
+// Where to center the view along one axis, keeping it inside min to max if
+// it fits
+func cameraAxis(pos float64, min float64, max float64, half float64) float64 {
+	if max-min < 2*half {
+		return (min + max) / 2
+	}
+
+	return pixel.Clamp(pos, min+half, max-half)
+}
+
+// Where the mouse is in the world
+func mouseWorldPosition() pixel.Vec {
+	return camera.Unproject(win.MousePosition())
+}
+
+func drawWorldBorder(imd *imdraw.IMDraw) {
+	imd.Color = colornames.Black
+	imd.Push(world.Bounds.Min, world.Bounds.Max)
+	imd.Rectangle(WORLD_BORDER_WIDTH)
+}
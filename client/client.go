@@ -5,6 +5,7 @@ import (
 	"../clocklib"
 	"../crdtlib"
 	"../serverlib"
+	"../worldlib"
 	"bitbucket.org/bestchai/dinv/dinvRT"
 	"flag"
 	"fmt"
@@ -50,7 +51,6 @@ var (
 	LocalAddr              *net.UDPAddr
 	RPCAddr                *net.TCPAddr
 	UpdateChannel          = make(chan clientlib.Update, 1000)
-	Clock                  = &clocklib.ClockManager{}
 	KVMap                  = struct {
 		sync.RWMutex
 		M map[uint64]crdtlib.ValueType
@@ -64,16 +64,19 @@ var (
 	UseDinv      bool
 )
 
+// Synchronized time. Every worker goes through it, so tests can run them on a
+// clocklib.FakeClock.
+var Clock clocklib.ClockManagerAPI = clocklib.NewClockManager(clocklib.RealClock{})
+
 var (
-	playerPic   pixel.Picture
-	bulletPic   pixel.Picture
-	localPlayer *Player
-	players     = make(map[uint64]*Player)
-	// Keep a separate list of player IDs around because go maps don't have a stable iteration order
-	playerIds []uint64
-	bullets   []*Bullet
-	alive     = true
+	playerPic pixel.Picture
+	bulletPic pixel.Picture
+	world     *worldlib.World
 	isBot     bool
+	// Last phase of the match we logged
+	matchPhase worldlib.MatchPhase
+	// Peers only take us if they're playing on the same map
+	GameMap = worldlib.EmptyMap()
 )
 
 func main() {
@@ -81,8 +84,38 @@ func main() {
 
 	botFlag := flag.Bool("bot", false, "Runs the bot player")
 	cpuprofile := flag.String("cpuprofile", "", "write a cpu profile")
+	roomName := flag.String("room", "", "Joins the named game room, creating it if needed")
+	listRooms := flag.Bool("list-rooms", false, "Lists the game rooms on the server and exits")
+	clockStats := flag.Bool("clock-stats", false, "Shows how well clocks are synchronized in the room and exits")
+	holdWindow := flag.Duration("hold-window", DEFAULT_HOLD_WINDOW, "How long to hold updates so they can be applied in order")
+	batchInterval := flag.Duration("batch-interval", DEFAULT_BATCH_INTERVAL, "How often to send batched updates to peers")
+	dissemination := flag.String("dissemination", "flood", "How updates spread to peers: flood or gossip")
+	gossipFanout := flag.Int("gossip-fanout", DEFAULT_GOSSIP_FANOUT, "How many peers gossip sends each update to")
+	gossipTTL := flag.Int("gossip-ttl", DEFAULT_GOSSIP_TTL, "How many hops gossip sends each update for")
+	clockSync := flag.String("clock-sync", CLOCK_SYNC_AUTO, "Who synchronizes clocks: server, peer, or auto (peers once the server goes quiet)")
+	mapFile := flag.String("map", "", "Loads walls and spawn points from a map file; everyone in the room has to use the same one")
 	flag.Parse()
 	isBot = *botFlag
+	BatchInterval = *batchInterval
+	Events = clientlib.NewEventBuffer(*holdWindow)
+
+	var err error
+	Dissemination, err = NewDissemination(*dissemination, *gossipFanout, *gossipTTL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err = ValidateClockSyncMode(*clockSync); err != nil {
+		log.Fatal(err)
+	}
+	ClockSyncMode = *clockSync
+
+	if *mapFile != "" {
+		if GameMap, err = worldlib.LoadMap(*mapFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	PickupSeed = worldlib.PickupSeed(*roomName, GameMap)
 
 	// start profiling
 	if *cpuprofile != "" {
@@ -105,7 +138,6 @@ func main() {
   KVDir = displayName + "-stats-directory"
   fmt.Println("KVDir: " + KVDir)
 
-	var err error
 	LocalAddr, err = net.ResolveUDPAddr("udp", localAddrString)
 	if err != nil {
 		log.Fatal(err)
@@ -189,6 +221,37 @@ func main() {
 		dinvRT.Track(clientName, "display_name", displayName)
 	}
 
+	if *listRooms {
+		rooms, err := Server.ListRooms(ID, Logger)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, room := range rooms {
+			fmt.Printf("%s\t%d players\n", room.Name, room.NumPlayers)
+		}
+		return
+	}
+
+	if *clockStats {
+		stats, err := Server.GetClockStats(ID, *roomName, Logger)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, s := range stats {
+			fmt.Printf("%d\tskew %v ± %v\trtt %v\tdrift %.1f ppm\tsynced %v\n",
+				s.ClientID, s.Skew, s.ErrorBound, s.RTT, s.DriftPPM, s.LastSync.Format(time.StampMilli))
+		}
+		return
+	}
+
+	if *roomName != "" {
+		if err = joinRoom(ID, *roomName); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	ready := make(chan error)
 
 	// Start the clock worker now
@@ -217,15 +280,19 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// Create the local player
-	localPlayer = NewPlayer(NetworkSettings.UniqueUserID)
-	localPlayer.Pos = windowCfg.Bounds.Center()
+	// Create the world, along with the local player
+	world = worldlib.NewWorld(NetworkSettings.UniqueUserID, GameMap)
+	world.PickupSeed = PickupSeed
 
 	// Start workers
 	go PeerWorker()
 	go RecordWorker()
 	go OutgoingWorker()
 	go ListenerWorker()
+	go AntiEntropyWorker()
+	go PartitionWorker()
+	go DisseminationStatsWorker()
+	go PeerClockSyncWorker()
 
 	// Run the main thread
 	if isBot {
@@ -234,6 +301,12 @@ func main() {
 	} else {
 		pixelgl.Run(run)
 	}
+
+	// Tell everyone we're leaving, since nobody else can, and give it time to
+	// go out
+	RecordUpdates <- clientlib.DeadPlayer(ID, 0).Timestamp(Clock.GetCurrentTime())
+	Clock.Sleep(2 * BatchInterval)
+
 	ack, err := Server.Disconnect(ID, Logger, UseDinv)
 	if !ack {
 		fmt.Println("Failed to disconnect from server")
@@ -244,16 +317,26 @@ func main() {
 var win *pixelgl.Window
 
 func runBot() {
-	go GenerateMoves()
+	bot := NewBot()
+
+	last := Clock.Now()
 	for {
-		// Since this doesn't update bullets, you can't kill the bot!
-		doAcceptUpdates()
+		dt := Clock.Since(last).Seconds()
+		last = Clock.Now()
+
+		// The bot plays by the same rules as everyone else, so it can be killed
+		doTick(dt, bot.Input())
+
+		elapsed := Clock.Since(last)
+		if elapsed < TickInterval {
+			Clock.Sleep(TickInterval - elapsed)
+		}
 	}
 }
 
 func FlushLogs() {
 	for {
-		time.Sleep(time.Second * 30)
+		Clock.Sleep(time.Second * 30)
 		PeerLogger.Flush()
 	}
 }
@@ -267,106 +350,42 @@ func run() {
 
 	win.SetSmooth(true)
 
-	last := time.Now()
+	last := Clock.Now()
 	for !win.Closed() {
-		dt := time.Since(last).Seconds()
-		last = time.Now()
+		dt := Clock.Since(last).Seconds()
+		last = Clock.Now()
 
-		// Update existing bullets
-		doUpdateBullets(dt)
-
-		// Update the local player with local input, if we're alive
-		if alive {
-			doLocalInput(dt)
-		}
-
-		// Accept all waiting events
-		doAcceptUpdates()
+		// Step the world with whatever the player is doing
+		doTick(dt, readInput())
 
 		// Draw everything
 		doDraw()
 	}
 }
 
-func doUpdateBullets(dt float64) {
-	for i, bullet := range bullets {
-		bullet.Update(dt)
-
-		if !win.Bounds().Contains(bullet.Pos) {
-			// kill this bullet
-			if i+1 < len(bullets) {
-				bullets = append(bullets[:i], bullets[i+1:]...)
-			} else {
-				bullets = bullets[:i]
-			}
-		} else if bullet.Pos.Sub(localPlayer.Pos).Len() < PlayerHitBounds && alive {
-			// we've been hit!
-			alive = false
-
-			go func() {
-				// Increment our death count
-				// Ignore error in this case
-				value, _ := KVGet(localPlayer.ID)
-
-				value.NumDeaths += 1
+// Advances the world by dt, sends out whatever the local player did and then
+// accepts all waiting events
+func doTick(dt float64, input worldlib.Input) {
+	for _, update := range world.Tick(dt, input, Clock.GetCurrentTime()) {
+		// Tell everybody else about it
+		RecordUpdates <- update
+	}
 
-				err := KVPut(localPlayer.ID, value)
-				if err != nil {
-					log.Fatal(err)
-				}
-			}()
+	doAcceptUpdates()
+	doCommitUpdates()
 
-			RecordUpdates <- clientlib.DeadPlayer(localPlayer.ID, bullet.PlayerID).Timestamp(Clock.GetCurrentTime())
-		}
+	if phase := world.Phase(Clock.GetCurrentTime()); phase != matchPhase {
+		log.Println("Match is now", phase)
+		matchPhase = phase
 	}
 }
 
+// Shows whatever has arrived from other players
 func doAcceptUpdates() {
 	for {
 		select {
 		case update := <-UpdateChannel:
-			if update.PlayerID == localPlayer.ID {
-				// We already know about ourselves
-				continue
-			}
-
-			if players[update.PlayerID] == nil {
-				// New player, create it
-				players[update.PlayerID] = NewPlayer(update.PlayerID)
-				playerIds = append(playerIds, update.PlayerID)
-			}
-
-			// Update the player with what we received
-			switch update.Kind {
-			case clientlib.DEAD:
-				// Remove the player if they're dead
-				delete(players, update.PlayerID)
-				// make a new list of players
-				playerIds = nil
-				for id := range players {
-					playerIds = append(playerIds, id)
-				}
-
-				if update.OtherPlayer == localPlayer.ID {
-					go func() {
-						// Increment our kill count
-						// Ignore error in this case
-						value, _ := KVGet(localPlayer.ID)
-
-						value.NumKills += 1
-
-						err := KVPut(localPlayer.ID, value)
-						if err != nil {
-							log.Fatal(err)
-						}
-					}()
-				}
-			case clientlib.FIRE:
-				// Add a bullet
-				bullets = append(bullets, NewBullet(update.PlayerID, update.Pos, update.Angle))
-			default:
-				players[update.PlayerID].Accept(update)
-			}
+			world.Accept(update, Clock.GetCurrentTime())
 		default:
 			// Done if there are no more events waiting
 			return
@@ -374,93 +393,260 @@ func doAcceptUpdates() {
 	}
 }
 
-func doLocalInput(dt float64) {
-	update := localPlayer.Update()
+// Settles the updates whose turn has come, in the same order as everyone else,
+// with the ones the match makes by itself in between
+func doCommitUpdates() {
+	now := Clock.GetCurrentTime()
 
-	if win.Pressed(pixelgl.KeyA) {
-		update = update.MoveLeft(dt)
+	for _, update := range Events.Release(now) {
+		for _, due := range world.MatchUpdates(update.Time) {
+			commitUpdate(due)
+		}
+		commitUpdate(update)
 	}
 
-	if win.Pressed(pixelgl.KeyD) {
-		update = update.MoveRight(dt)
+	// Nothing else can come before the hold window now
+	for _, due := range world.MatchUpdates(now.Add(-Events.Hold())) {
+		commitUpdate(due)
 	}
+}
 
-	if win.Pressed(pixelgl.KeyS) {
-		update = update.MoveDown(dt)
+// Commits one update, and keeps score of any death it causes or match it ends
+func commitUpdate(update clientlib.Update) {
+	outcome := world.Commit(update)
+	if update.Kind == clientlib.RESPAWN && outcome.Counted {
+		noteRespawn(update.PlayerID)
 	}
-
-	if win.Pressed(pixelgl.KeyW) {
-		update = update.MoveUp(dt)
+	if update.Kind == clientlib.PICKUP && outcome.Counted {
+		// A full magazine again, without reloading
+		if pickup, _ := worldlib.SpawnPickup(PickupSeed, GameMap, update.Ref); pickup.Kind == worldlib.AmmoPickup {
+			noteRearm(update.PlayerID, update.Time)
+		}
+	}
+	if outcome.Left {
+		// Gone, but free to join again afresh
+		noteRespawn(update.PlayerID)
+		forgetPlayer(update.PlayerID)
+		noteFinished(outcome)
+		return
+	}
+	if !outcome.Died {
+		return
 	}
 
-	if win.Pressed(pixelgl.KeyEnter) {
-		// move to the mouse position when enter is pressed (bad behavior)
-		update.Pos = win.MousePosition()
+	noteDeath(update.PlayerID, update.Time)
+
+	// The dead go quiet; that doesn't mean the overlay split
+	forgetPlayer(update.PlayerID)
+
+	if outcome.Killer != 0 {
+		log.Println("Player", update.PlayerID, "was killed by", outcome.Killer, "with bullet", outcome.Bullet)
 	}
 
-	update = update.
-		UpdateAngle(win.MousePosition()).
-		Bound(windowCfg.Bounds).
-		Timestamp(Clock.GetCurrentTime())
+	if update.PlayerID == world.Local.ID {
+		go func() {
+			// Increment our death count
+			// Ignore error in this case
+			value, _ := KVGet(world.Local.ID)
 
-	// Update our local player immediately
-	localPlayer.Accept(update)
+			value.NumDeaths += 1
 
-	if win.JustPressed(pixelgl.MouseButtonLeft) {
-		FireBullet()
+			err := KVPut(world.Local.ID, value)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}()
+	} else if outcome.Killer == world.Local.ID {
+		go func() {
+			// Increment our kill count
+			// Ignore error in this case
+			value, _ := KVGet(world.Local.ID)
+
+			value.NumKills += 1
+
+			err := KVPut(world.Local.ID, value)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}()
 	}
 
-	// Tell everybody else about it
-	RecordUpdates <- update
+	noteFinished(outcome)
 }
 
-func FireBullet() {
-	// fire a bullet if the mouse button was pressed
-	offset := pixel.V(math.Cos(localPlayer.Angle), math.Sin(localPlayer.Angle)).Scaled(30)
-	position := localPlayer.Pos.Add(offset)
+// Keeps score of a match the outcome ended, if it did
+func noteFinished(outcome worldlib.Outcome) {
+	if !outcome.Finished {
+		return
+	}
+
+	log.Println("Match over, winner is", outcome.Winner)
+
+	if outcome.Winner == world.Local.ID {
+		go func() {
+			// Increment our win count
+			// Ignore error in this case
+			value, _ := KVGet(world.Local.ID)
 
-	// Add the bullet to our list
-	bullets = append(bullets, NewBullet(localPlayer.ID, position, localPlayer.Angle))
+			value.NumWins += 1
 
-	// Send an update about this bullet that was fired
-	RecordUpdates <- clientlib.FireBullet(localPlayer.ID, position, localPlayer.Angle).Timestamp(Clock.GetCurrentTime())
+			err := KVPut(world.Local.ID, value)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+}
+
+func readInput() worldlib.Input {
+	var move pixel.Vec
+
+	if win.Pressed(pixelgl.KeyA) {
+		move.X -= clientlib.PlayerSpeed
+	}
+
+	if win.Pressed(pixelgl.KeyD) {
+		move.X += clientlib.PlayerSpeed
+	}
+
+	if win.Pressed(pixelgl.KeyS) {
+		move.Y -= clientlib.PlayerSpeed
+	}
+
+	if win.Pressed(pixelgl.KeyW) {
+		move.Y += clientlib.PlayerSpeed
+	}
+
+	input := worldlib.Input{
+		Move:   move,
+		Angle:  mouseWorldPosition().Sub(world.Local.Pos).Angle(),
+		Fire:   win.Pressed(pixelgl.MouseButtonLeft),
+		Reload: win.JustPressed(pixelgl.KeyR),
+	}
+
+	// Number keys pick a weapon
+	for i, key := range []pixelgl.Button{pixelgl.Key1, pixelgl.Key2, pixelgl.Key3} {
+		if win.JustPressed(key) {
+			weapon := i
+			input.Weapon = &weapon
+		}
+	}
+
+	if win.Pressed(pixelgl.KeyEnter) {
+		// move to the mouse position when enter is pressed (bad behavior)
+		mouse := mouseWorldPosition()
+		input.Warp = &mouse
+	}
+
+	return input
 }
 
 var imd = imdraw.New(nil)
 
+const (
+	HealthBarWidth  = 40.0
+	HealthBarHeight = 5.0
+	HealthBarOffset = 30.0
+	// The ammo bar goes just under it
+	AmmoBarOffset = HealthBarOffset - 2*HealthBarHeight
+)
+
 func doDrawLocal() {
 	imd.Clear()
 
+	local := world.Local
 	lineLength := win.Bounds().Max.Sub(win.Bounds().Min).Len()
-	endPoint := pixel.V(math.Cos(localPlayer.Angle), math.Sin(localPlayer.Angle)).
-		Scaled(lineLength).Add(localPlayer.Pos)
+	endPoint := pixel.V(math.Cos(local.Angle), math.Sin(local.Angle)).
+		Scaled(lineLength).Add(local.Pos)
 
 	imd.Color = colornames.Darkred
-	imd.Push(localPlayer.Pos, endPoint)
+	imd.Push(local.Pos, endPoint)
 	imd.Line(3)
 
+	// Health bar above the tank
+	barMin := local.Pos.Add(pixel.V(-HealthBarWidth/2, HealthBarOffset))
+	barFull := barMin.Add(pixel.V(HealthBarWidth, HealthBarHeight))
+	barLeft := barMin.Add(pixel.V(HealthBarWidth*float64(world.Health(local.ID))/worldlib.MaxHealth, HealthBarHeight))
+
+	imd.Color = colornames.Lightgray
+	imd.Push(barMin, barFull)
+	imd.Rectangle(0)
+	imd.Color = colornames.Forestgreen
+	imd.Push(barMin, barLeft)
+	imd.Rectangle(0)
+
+	// and how much is left in the magazine, greyed out while reloading
+	weapon, ammo := world.Weapon()
+	ammoMin := local.Pos.Add(pixel.V(-HealthBarWidth/2, AmmoBarOffset))
+	ammoLeft := ammoMin.Add(pixel.V(HealthBarWidth*float64(ammo)/float64(worldlib.Weapons[weapon].Magazine), HealthBarHeight))
+
+	imd.Color = colornames.Gold
+	if world.Reloading(Clock.GetCurrentTime()) {
+		imd.Color = colornames.Darkgray
+	}
+	imd.Push(ammoMin, ammoLeft)
+	imd.Rectangle(0)
+
 	imd.Draw(win)
-	localPlayer.Draw(win)
+	DrawPlayer(win, local)
 }
 
 func doDraw() {
-	// Clear the screen
+	// Clear the screen, and look at the part of the world around us
 	win.Clear(colornames.Whitesmoke)
+	updateCamera()
+
+	// then the walls, under everything else
+	imd.Clear()
+	drawWorldBorder(imd)
+	imd.Color = colornames.Slategray
+	for _, wall := range GameMap.Walls {
+		imd.Push(wall...)
+		imd.Polygon(0)
+	}
+
+	// and the pickups lying around
+	for _, pickup := range world.Pickups(Clock.GetCurrentTime()) {
+		DrawPickup(imd, pickup)
+	}
+	imd.Draw(win)
 
 	// Draw ourselves if we're alive
-	if alive {
+	if world.Alive {
 		doDrawLocal()
 	}
 
 	// draw all the other players
-	for _, id := range playerIds {
-		players[id].Draw(win)
+	for _, id := range world.PlayerIDs {
+		DrawPlayer(win, world.Players[id])
 	}
 
 	// then draw bullets
-	for _, bullet := range bullets {
-		bullet.Draw(win)
+	for _, bullet := range world.Bullets {
+		DrawBullet(win, bullet)
+	}
+
+	// shields around whoever has one up
+	imd.Clear()
+	now := Clock.GetCurrentTime()
+	if world.Alive && world.Shielded(world.Local.ID, now) {
+		DrawShield(imd, world.Local.Shown)
+	}
+	for _, id := range world.PlayerIDs {
+		if world.Shielded(id, now) {
+			DrawShield(imd, world.Players[id].Shown)
+		}
+	}
+
+	// and the edge of the safe zone, once it starts closing in
+	if world.Phase(now) == worldlib.Running {
+		center, radius := world.Zone(now)
+
+		imd.Color = colornames.Orangered
+		imd.Push(center)
+		imd.Circle(radius, 3)
 	}
+	imd.Draw(win)
 
 	win.Update()
 }
@@ -481,6 +667,32 @@ func loadPicture(path string) (pixel.Picture, error) {
 	return pixel.PictureDataFromImage(img), nil
 }
 
+// Joins a room on the server, creating it first if nobody has yet
+func joinRoom(id uint64, name string) error {
+	rooms, err := Server.ListRooms(id, Logger)
+	if err != nil {
+		return err
+	}
+
+	exists := false
+	for _, room := range rooms {
+		if room.Name == name {
+			exists = true
+			break
+		}
+	}
+
+	if !exists {
+		if err := Server.CreateRoom(id, name, Logger); err != nil {
+			// Somebody may have beaten us to it, in which case joining still works
+			log.Println("Error creating room", name, "with error:", err)
+		}
+	}
+
+	log.Println("Joining room", name)
+	return Server.JoinRoom(id, name, Logger)
+}
+
 func findIDFile(displayName string) (id uint64, err error) {
 	filePath := "./" + displayName + ".ID"
 	if _, err = os.Stat(filePath); err != nil {
@@ -34,7 +34,8 @@ func WriteKVPair(key uint64, value crdtlib.ValueType) error {
 
 	v0 := strconv.FormatInt(int64(value.NumKills), 10)
 	v1 := strconv.FormatInt(int64(value.NumDeaths), 10)
-	valueStr := v0 + "\n" + v1 + "\n"
+	v2 := strconv.FormatInt(int64(value.NumWins), 10)
+	valueStr := v0 + "\n" + v1 + "\n" + v2 + "\n"
 	valueBytes := []byte(valueStr)
 	err := ioutil.WriteFile(fname, valueBytes, 0644)
 	if err != nil {
@@ -96,18 +97,31 @@ func (c *ClockController) TimeRequest(request clientlib.GetTimeRequest, t *clien
 func (c *ClockController) SetOffset(request clientlib.SetOffsetRequest, response *clientlib.SetOffsetResponse) error {
 	var offset time.Duration
 	Logger.UnpackReceive("SetOffset() command received from server", request.B, &offset)
-	Clock.SetOffset(request.Offset)
+	if !adjustFromServer(func() { Clock.SetOffset(request.Offset) }) {
+		log.Println("SetOffset() ignored, peers sync our clock")
+	}
 	b := Logger.PrepareSend("SetOffset() command executed", true)
 	*response = clientlib.SetOffsetResponse{true, b}
 	return nil
 }
 
+func (c *ClockController) AdjustOffset(request clientlib.AdjustOffsetRequest, response *clientlib.SetOffsetResponse) error {
+	var delta time.Duration
+	Logger.UnpackReceive("AdjustOffset() command received from server", request.B, &delta)
+	if !adjustFromServer(func() { Clock.AdjustOffset(request.Delta) }) {
+		log.Println("AdjustOffset() ignored, peers sync our clock")
+	}
+	b := Logger.PrepareSend("AdjustOffset() command executed", true)
+	*response = clientlib.SetOffsetResponse{true, b}
+	return nil
+}
+
 func (c *ClockController) Heartbeat(clientID uint64, ack *bool) error {
 	peerLock.Lock()
 	defer peerLock.Unlock()
 
 	if _, ok := peers[clientID]; ok {
-		peers[clientID].LastHeartbeat = Clock.GetCurrentTime()
+		peers[clientID].LastHeartbeat = Clock.Now()
 	}
 
 	return nil
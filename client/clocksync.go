@@ -0,0 +1,146 @@
+package main
+
+import (
+	"../clientlib"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Peer-to-peer clock synchronization, for when the server can't do it for us.
+// Every round we sample each peer's clock and slew ours towards the average of
+// the neighbourhood, counting ourselves as a zero sample. Since every client
+// does the same, clocks converge on a common time across the whole overlay as
+// long as it is connected, without anyone being in charge.
+//
+// Only one of the server and our peers adjusts our clock at a time, or they
+// would pull it back and forth between them. In auto mode the server wins: a
+// peer round is thrown away if the server adjusted us while it was sampling.
+
+const (
+	PEER_CLOCK_SYNC_INTERVAL = 10 * time.Second
+	// In auto mode, peers take over if the server hasn't synced us for this
+	// long, which is a few of its sync rounds
+	SERVER_CLOCK_SYNC_STALE = 45 * time.Second
+)
+
+const (
+	CLOCK_SYNC_SERVER = "server"
+	CLOCK_SYNC_PEER   = "peer"
+	CLOCK_SYNC_AUTO   = "auto"
+)
+
+var (
+	ClockSyncMode = CLOCK_SYNC_AUTO
+)
+
+// Held while adjusting our clock, along with when the server last did
+var lastServerClockSync = struct {
+	sync.Mutex
+	t time.Time
+}{}
+
+type UnknownClockSyncError string
+
+func (e UnknownClockSyncError) Error() string {
+	return fmt.Sprintf("Unknown clock sync mode [%s].", string(e))
+}
+
+func ValidateClockSyncMode(mode string) error {
+	switch mode {
+	case CLOCK_SYNC_SERVER, CLOCK_SYNC_PEER, CLOCK_SYNC_AUTO:
+		return nil
+	}
+
+	return UnknownClockSyncError(mode)
+}
+
+// Lets the server adjust our clock, unless our peers are in charge of it.
+// Returns whether it did.
+func adjustFromServer(adjust func()) bool {
+	if ClockSyncMode == CLOCK_SYNC_PEER {
+		return false
+	}
+
+	lastServerClockSync.Lock()
+	defer lastServerClockSync.Unlock()
+
+	adjust()
+	lastServerClockSync.t = Clock.Now()
+	return true
+}
+
+func shouldSyncWithPeers() bool {
+	switch ClockSyncMode {
+	case CLOCK_SYNC_PEER:
+		return true
+	case CLOCK_SYNC_SERVER:
+		return false
+	}
+
+	lastServerClockSync.Lock()
+	defer lastServerClockSync.Unlock()
+
+	// Give the server a chance to sync us first
+	if lastServerClockSync.t.IsZero() {
+		lastServerClockSync.t = Clock.Now()
+		return false
+	}
+
+	return Clock.Since(lastServerClockSync.t) > SERVER_CLOCK_SYNC_STALE
+}
+
+func PeerClockSyncWorker() {
+	for {
+		Clock.Sleep(PEER_CLOCK_SYNC_INTERVAL)
+
+		if !shouldSyncWithPeers() {
+			continue
+		}
+
+		syncWithPeers()
+	}
+}
+
+func syncWithPeers() {
+	peerLock.Lock()
+	remotes := make(map[uint64]*clientlib.ClientClockRemote, len(peers))
+	for id, peer := range peers {
+		remotes[id] = peer.Rpc
+	}
+	peerLock.Unlock()
+
+	if len(remotes) == 0 {
+		return
+	}
+
+	// Sampling takes a while, so do it without holding the lock
+	started := Clock.Now()
+	var offsetTotal time.Duration
+	n := 1 // us
+	for id, remote := range remotes {
+		sample, err := clientlib.SampleClock(remote, Clock.GetCurrentTime, Logger)
+		if err != nil {
+			log.Println("syncWithPeers() unable to sample clock of peer", id)
+			continue
+		}
+
+		offsetTotal += sample.Offset
+		n++
+	}
+
+	adjustment := offsetTotal / time.Duration(n)
+
+	lastServerClockSync.Lock()
+	defer lastServerClockSync.Unlock()
+
+	if ClockSyncMode == CLOCK_SYNC_AUTO && lastServerClockSync.t.After(started) {
+		// The server is back, and our samples are from before it moved us
+		log.Println("syncWithPeers() server adjusted the clock meanwhile, dropping round")
+		return
+	}
+
+	log.Println("syncWithPeers() adjusting clock by", adjustment, "from", n-1, "peers")
+	Clock.AdjustOffset(adjustment)
+}
@@ -35,8 +35,13 @@ func KVStoreSetup() (map[uint64]crdtlib.ValueType, error) {
 		dataStr := strings.Split(string(data), "\n")
 		v0, _ := strconv.Atoi(dataStr[0])
 		v1, _ := strconv.Atoi(dataStr[1])
+		// Older stats files have no wins
+		var v2 int
+		if len(dataStr) > 2 {
+			v2, _ = strconv.Atoi(dataStr[2])
+		}
 		k, _ := strconv.Atoi(fname)
-		val := crdtlib.ValueType{v0, v1}
+		val := crdtlib.ValueType{v0, v1, v2}
 		M[uint64(k)] = val
 	}
 
@@ -61,7 +66,7 @@ func KVGet(key uint64) (crdtlib.ValueType, error) {
 
 func KVPut(key uint64, value crdtlib.ValueType) error {
 
-	err := Server.KVPut(key, value, KVLogger)
+	err := Server.KVPut(key, value, NetworkSettings.UniqueUserID, KVLogger)
 
 	return err
 
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"../clientlib"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// How accepted updates are spread through the overlay. Flooding sends every
+// update to every peer; gossip sends it to a few random peers for a limited
+// number of hops, and repairs whatever that misses with anti-entropy.
+type DisseminationStrategy interface {
+	// Whether an update we accepted should be passed on
+	ShouldForward(update clientlib.Update) bool
+	// Which of our peers an update should be sent to
+	Targets(update clientlib.Update, peers []*PeerRecord) []*PeerRecord
+	// How often to run anti-entropy with a random peer, or zero to never run it
+	AntiEntropyInterval() time.Duration
+}
+
+const (
+	DEFAULT_GOSSIP_FANOUT       = 2
+	DEFAULT_GOSSIP_TTL          = 4
+	DEFAULT_ANTI_ENTROPY_PERIOD = 500 * time.Millisecond
+	DISSEMINATION_STATS_PERIOD  = 10 * time.Second
+)
+
+var (
+	Dissemination DisseminationStrategy = Flood{}
+)
+
+type UnknownDisseminationError string
+
+func (e UnknownDisseminationError) Error() string {
+	return fmt.Sprintf("Unknown dissemination strategy [%s].", string(e))
+}
+
+func NewDissemination(name string, fanout int, ttl int) (DisseminationStrategy, error) {
+	switch name {
+	case "flood":
+		return Flood{}, nil
+	case "gossip":
+		return Gossip{
+			Fanout:      fanout,
+			TTL:         ttl,
+			AntiEntropy: DEFAULT_ANTI_ENTROPY_PERIOD,
+		}, nil
+	}
+
+	return nil, UnknownDisseminationError(name)
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+
+// Strategies
+
+// Sends every update to every peer. Loops are stopped by the nonce history.
+type Flood struct{}
+
+func (Flood) ShouldForward(update clientlib.Update) bool {
+	return true
+}
+
+func (Flood) Targets(update clientlib.Update, peers []*PeerRecord) []*PeerRecord {
+	var targets []*PeerRecord
+	for _, peer := range peers {
+		if peer.ClientID != update.PlayerID {
+			targets = append(targets, peer)
+		}
+	}
+
+	return targets
+}
+
+func (Flood) AntiEntropyInterval() time.Duration {
+	return 0
+}
+
+// Sends every update to Fanout random peers, for at most TTL hops
+type Gossip struct {
+	Fanout      int
+	TTL         int
+	AntiEntropy time.Duration
+}
+
+func (g Gossip) ShouldForward(update clientlib.Update) bool {
+	return update.Hops < g.TTL
+}
+
+func (g Gossip) Targets(update clientlib.Update, peers []*PeerRecord) []*PeerRecord {
+	targets := Flood{}.Targets(update, peers)
+
+	// Pick Fanout of them at random
+	rand.Shuffle(len(targets), func(i, j int) { targets[i], targets[j] = targets[j], targets[i] })
+	if len(targets) > g.Fanout {
+		targets = targets[:g.Fanout]
+	}
+
+	return targets
+}
+
+func (g Gossip) AntiEntropyInterval() time.Duration {
+	return g.AntiEntropy
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+
+// Anti-entropy
+
+// Periodically swaps digests with a random peer, so that updates gossip missed
+// still make it everywhere
+func AntiEntropyWorker() {
+	interval := Dissemination.AntiEntropyInterval()
+	if interval == 0 {
+		return
+	}
+
+	for {
+		Clock.Sleep(interval)
+
+		peerLock.Lock()
+		var peer *PeerRecord
+		if len(peers) > 0 {
+			index, count := rand.Intn(len(peers)), 0
+			for _, p := range peers {
+				if count == index {
+					peer = p
+					break
+				}
+				count++
+			}
+		}
+		peerLock.Unlock()
+
+		if peer == nil {
+			continue
+		}
+
+		// Push our digest, and pull theirs in reply
+		err := peer.Api.NotifyDigest(NetworkSettings.UniqueUserID, historyDigest(), true)
+		if err != nil {
+			// Too noisy to log
+		}
+		disseminationStats.digest()
+	}
+}
+
+func (*ClientListener) NotifyDigest(clientID uint64, nonces []uint64, wantReply bool) error {
+	peerLock.Lock()
+	peer, ok := peers[clientID]
+	peerLock.Unlock()
+
+	if !ok {
+		// We don't talk to this peer
+		return nil
+	}
+
+	// Send them whatever they're missing
+	if missing := historyMissing(nonces); len(missing) > 0 {
+		if err := peer.Api.NotifyUpdates(NetworkSettings.UniqueUserID, missing); err != nil {
+			return err
+		}
+		disseminationStats.repaired(len(missing))
+	}
+
+	if wantReply {
+		disseminationStats.digest()
+		return peer.Api.NotifyDigest(NetworkSettings.UniqueUserID, historyDigest(), false)
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+
+// Statistics, so strategies can be compared
+
+type DisseminationStats struct {
+	updatesSent     uint64
+	digestsSent     uint64
+	updatesRepaired uint64
+	accepts         uint64
+	duplicates      uint64
+	// Totals over accepted remote updates, to work out averages
+	remoteAccepts uint64
+	totalHops     uint64
+	totalDelay    int64
+}
+
+var disseminationStats DisseminationStats
+
+func (s *DisseminationStats) sent(n int) {
+	atomic.AddUint64(&s.updatesSent, uint64(n))
+}
+
+func (s *DisseminationStats) digest() {
+	atomic.AddUint64(&s.digestsSent, 1)
+}
+
+func (s *DisseminationStats) repaired(n int) {
+	atomic.AddUint64(&s.updatesRepaired, uint64(n))
+}
+
+func (s *DisseminationStats) duplicate() {
+	atomic.AddUint64(&s.duplicates, 1)
+}
+
+func (s *DisseminationStats) accepted(update clientlib.Update) {
+	atomic.AddUint64(&s.accepts, 1)
+
+	if update.Hops > 0 {
+		atomic.AddUint64(&s.remoteAccepts, 1)
+		atomic.AddUint64(&s.totalHops, uint64(update.Hops))
+		atomic.AddInt64(&s.totalDelay, int64(Clock.GetCurrentTime().Sub(update.Time)))
+	}
+}
+
+func (s *DisseminationStats) String() string {
+	remote := atomic.LoadUint64(&s.remoteAccepts)
+	var avgHops float64
+	var avgDelay time.Duration
+	if remote > 0 {
+		avgHops = float64(atomic.LoadUint64(&s.totalHops)) / float64(remote)
+		avgDelay = time.Duration(atomic.LoadInt64(&s.totalDelay) / int64(remote))
+	}
+
+	return fmt.Sprintf("sent %d updates, %d digests, repaired %d; accepted %d, %d duplicates; %.2f hops and %v delay on average",
+		atomic.LoadUint64(&s.updatesSent),
+		atomic.LoadUint64(&s.digestsSent),
+		atomic.LoadUint64(&s.updatesRepaired),
+		atomic.LoadUint64(&s.accepts),
+		atomic.LoadUint64(&s.duplicates),
+		avgHops,
+		avgDelay)
+}
+
+func DisseminationStatsWorker() {
+	for {
+		Clock.Sleep(DISSEMINATION_STATS_PERIOD)
+		log.Println("Dissemination:", disseminationStats.String())
+	}
+}
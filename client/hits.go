@@ -0,0 +1,186 @@
+package main
+
+import (
+	"../clientlib"
+	"../worldlib"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Hit confirmation. Every client claims the hits it sees with a HIT update.
+// A claim only stands if it agrees with the shot's trajectory, worked out from
+// the FIRE update and synchronized time, and with where the victim was at the
+// time, rewound from its recent positions.
+// A hit is confirmed once the shooter and at least one other player have made
+// standing claims. Every client confirms hits on its own from the same claims,
+// and makes the same DAMAGE update for it, so nobody has to announce them; and
+// a client that refuses to admit it was hit gets hurt anyway. Whether the
+// damage kills is settled when it is committed.
+// The DAMAGE update is stamped HIT_CONFIRM_WINDOW after the shooter's earliest
+// claim, and only witness claims from before then count, so it is stamped the
+// same everywhere whichever claims turn up first, and is never too late to
+// order.
+
+const (
+	// How long to remember shots, which is longer than any bullet flies
+	SHOT_MEMORY = 10 * time.Second
+	// How far a claimed hit may be from the shot's trajectory, to allow for
+	// bullets being stepped a frame at a time
+	HIT_TOLERANCE = 2 * worldlib.PlayerHitBounds
+	// Position updates are only sent so often, so the victim may have moved
+	// further than that since we last heard
+	VICTIM_TOLERANCE = 4 * worldlib.PlayerHitBounds
+	// How long after the shooter's claim a witness has to claim the same hit
+	HIT_CONFIRM_WINDOW = worldlib.MaxRewind
+)
+
+type hitKey struct {
+	shot   uint64
+	victim uint64
+}
+
+type hitClaims struct {
+	shooter uint64
+	// How much a hit from the shot takes away
+	damage int
+	// The shooter's earliest claim, once it has made one, and when each
+	// witness made theirs
+	shooterClaim *clientlib.Update
+	witnesses    map[uint64]time.Time
+	confirmed    bool
+}
+
+var (
+	// FIRE updates by nonce. Only touched by RecordWorker.
+	shots  = make(map[uint64]clientlib.Update)
+	claims = make(map[hitKey]*hitClaims)
+)
+
+type DisputedHitError string
+
+func (e DisputedHitError) Error() string {
+	return fmt.Sprintf("Disputed hit: %s", string(e))
+}
+
+func rememberShot(update clientlib.Update) {
+	shots[update.Nonce] = update
+	forgetOldShots()
+}
+
+func forgetOldShots() {
+	fence := Clock.GetCurrentTime().Add(-SHOT_MEMORY)
+
+	for nonce, shot := range shots {
+		if shot.Time.Before(fence) {
+			delete(shots, nonce)
+		}
+	}
+
+	for key := range claims {
+		if _, ok := shots[key.shot]; !ok {
+			delete(claims, key)
+		}
+	}
+}
+
+// Checks a claim against the shot it is about
+func checkClaim(claim clientlib.Update) error {
+	shot, ok := shots[claim.Ref]
+	if !ok {
+		return DisputedHitError("no such shot")
+	}
+
+	if claim.OtherPlayer == shot.PlayerID {
+		return DisputedHitError("shooter can't hit itself")
+	}
+
+	if claim.Time.Before(shot.Time) {
+		return DisputedHitError("hit before the shot was fired")
+	}
+
+	expected, going := worldlib.NewBullet(shot, shot.Time).At(GameMap, claim.Time)
+	if !going {
+		return DisputedHitError("bullet had stopped by then")
+	}
+	if expected.Sub(claim.Pos).Len() > HIT_TOLERANCE {
+		return DisputedHitError("bullet wasn't there")
+	}
+
+	victim, ok := records[claim.OtherPlayer]
+	if !ok {
+		return DisputedHitError("no such victim")
+	}
+
+	// Check against where the victim was when it was hit, not where it is now
+	if victim.PositionAt(claim.Time).Sub(claim.Pos).Len() > VICTIM_TOLERANCE {
+		return DisputedHitError("victim wasn't there")
+	}
+
+	return nil
+}
+
+// Counts a standing claim. Returns the DAMAGE update if it confirms a hit.
+func countClaim(claim clientlib.Update) (clientlib.Update, bool) {
+	key := hitKey{claim.Ref, claim.OtherPlayer}
+
+	c, ok := claims[key]
+	if !ok {
+		// Only shots from known weapons are remembered
+		weapon, _ := worldlib.WeaponFor(shots[claim.Ref].Weapon)
+
+		c = &hitClaims{
+			shooter:   shots[claim.Ref].PlayerID,
+			damage:    weapon.Damage,
+			witnesses: make(map[uint64]time.Time),
+		}
+		claims[key] = c
+	}
+
+	if claim.PlayerID == c.shooter {
+		// Claims can turn up in any order, so go by the earliest rather than
+		// whichever came first. Once the hit is confirmed it is too late to
+		// change, but only a shooter claiming the same hit twice can tell.
+		if c.shooterClaim == nil || (!c.confirmed && claim.Time.Before(c.shooterClaim.Time)) {
+			c.shooterClaim = &claim
+		}
+	} else if t, ok := c.witnesses[claim.PlayerID]; !ok || claim.Time.Before(t) {
+		c.witnesses[claim.PlayerID] = claim.Time
+	}
+
+	if c.confirmed || c.shooterClaim == nil {
+		return clientlib.Update{}, false
+	}
+
+	deadline := c.shooterClaim.Time.Add(HIT_CONFIRM_WINDOW)
+
+	witnessed := false
+	for _, t := range c.witnesses {
+		if !t.After(deadline) {
+			witnessed = true
+			break
+		}
+	}
+	if !witnessed {
+		return clientlib.Update{}, false
+	}
+
+	c.confirmed = true
+
+	// Everyone makes the same update for the same hit, so it is ordered
+	// the same way everywhere
+	damage := clientlib.DamagePlayer(claim.OtherPlayer, c.shooter, key.shot, c.damage)
+	damage.Time = deadline
+	damage.Nonce = key.shot ^ (key.victim * 0x9E3779B97F4A7C15)
+
+	return damage, true
+}
+
+// Applies a confirmed hit as if it had come in like any other update
+func confirmHit(damage clientlib.Update) {
+	log.Println("Confirmed hit on", damage.PlayerID, "by", damage.OtherPlayer)
+
+	if !Events.Push(damage) {
+		log.Println("Hit confirmed too late to be ordered, dropping it")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"../clientlib"
+	"github.com/faiface/pixel"
+	"sync"
+	"time"
+)
+
+// Interest management. Positions are most of what peers send each other, and a
+// player only needs them often for players near enough to see or shoot at. The
+// rest are only passed on every so often, so players far away still know the
+// others are alive, and roughly where they are. Every hop thins positions out
+// for the peer it passes them to, so a player only reachable through a peer
+// far away hears about its neighbours at the thinned rate too.
+
+const (
+	// How far from a peer's player a position has to be before it is thinned
+	// out, which is well past what the window shows
+	INTEREST_RADIUS = 1.5 * MaxX
+	// How often positions from outside that are still passed on. Often enough
+	// that peers don't think the players went quiet.
+	INTEREST_REFRESH = MEMBERSHIP_INTERVAL / 2
+)
+
+type interestKey struct {
+	peer   uint64
+	player uint64
+}
+
+var interest = struct {
+	sync.Mutex
+	// Where each player last said it was
+	positions map[uint64]pixel.Vec
+}{
+	positions: make(map[uint64]pixel.Vec),
+}
+
+// When we last passed on each player's position to each peer while it was out
+// of range. Only touched by OutgoingWorker.
+var thinned = make(map[interestKey]time.Time)
+
+func notePosition(playerID uint64, pos pixel.Vec) {
+	interest.Lock()
+	interest.positions[playerID] = pos
+	interest.Unlock()
+}
+
+func forgetPosition(playerID uint64) {
+	interest.Lock()
+	delete(interest.positions, playerID)
+	interest.Unlock()
+}
+
+// Whether a peer should get an update now. Everything but positions of players
+// far away from the peer's own always goes.
+// NOTE: only call from OutgoingWorker
+func interested(peerID uint64, update clientlib.Update, now time.Time) bool {
+	if update.Kind != clientlib.POSITION || update.PlayerID == peerID {
+		return true
+	}
+
+	interest.Lock()
+	pos, ok := interest.positions[peerID]
+	interest.Unlock()
+
+	if !ok || pos.Sub(update.Pos).Len() <= INTEREST_RADIUS {
+		// If we don't know where it is, it could be anywhere
+		return true
+	}
+
+	key := interestKey{peerID, update.PlayerID}
+	if now.Sub(thinned[key]) < INTEREST_REFRESH {
+		return false
+	}
+
+	thinned[key] = now
+	return true
+}
+
+// NOTE: only call from OutgoingWorker
+func pruneThinned(now time.Time) {
+	for key, sent := range thinned {
+		if now.Sub(sent) >= INTEREST_REFRESH {
+			delete(thinned, key)
+		}
+	}
+}
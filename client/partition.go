@@ -0,0 +1,173 @@
+package main
+
+import (
+	"../clientlib"
+	"log"
+	"sync"
+	"time"
+)
+
+// Peers tell each other which players they can hear from. If a player we know
+// about goes quiet, and none of our peers can hear it either, the overlay has
+// probably split; we ask the server for peers that bridge us back together.
+
+const (
+	MEMBERSHIP_INTERVAL = 2 * time.Second
+	UNREACHABLE_TIMEOUT = 3 * MEMBERSHIP_INTERVAL
+)
+
+type peerMembership struct {
+	members  map[uint64]bool
+	received time.Time
+}
+
+var membership = struct {
+	sync.Mutex
+	// When we last accepted an update from each player
+	heard map[uint64]time.Time
+	// Who each of our peers last said it can hear from
+	peers map[uint64]peerMembership
+}{
+	heard: make(map[uint64]time.Time),
+	peers: make(map[uint64]peerMembership),
+}
+
+func heardFrom(playerID uint64) {
+	membership.Lock()
+	membership.heard[playerID] = Clock.GetCurrentTime()
+	membership.Unlock()
+}
+
+func forgetPlayer(playerID uint64) {
+	membership.Lock()
+	delete(membership.heard, playerID)
+	delete(membership.peers, playerID)
+	membership.Unlock()
+}
+
+// Returns the players we have heard from recently
+func reachablePlayers() []uint64 {
+	membership.Lock()
+	defer membership.Unlock()
+
+	fence := Clock.GetCurrentTime().Add(-UNREACHABLE_TIMEOUT)
+
+	var members []uint64
+	for id, last := range membership.heard {
+		if last.After(fence) {
+			members = append(members, id)
+		}
+	}
+
+	return members
+}
+
+// Returns the players we know about but that neither we nor any of our peers
+// have heard from recently
+func unreachablePlayers() []uint64 {
+	membership.Lock()
+	defer membership.Unlock()
+
+	fence := Clock.GetCurrentTime().Add(-UNREACHABLE_TIMEOUT)
+
+	var unreachable []uint64
+	for id, last := range membership.heard {
+		if id == NetworkSettings.UniqueUserID || last.After(fence) {
+			continue
+		}
+
+		reachable := false
+		for _, peer := range membership.peers {
+			if peer.received.After(fence) && peer.members[id] {
+				reachable = true
+				break
+			}
+		}
+
+		if !reachable {
+			unreachable = append(unreachable, id)
+		}
+	}
+
+	return unreachable
+}
+
+func PartitionWorker() {
+	for {
+		Clock.Sleep(MEMBERSHIP_INTERVAL)
+
+		// Tell our peers who we can hear
+		members := reachablePlayers()
+
+		peerLock.Lock()
+		for _, peer := range peers {
+			err := peer.Api.NotifyMembership(NetworkSettings.UniqueUserID, members)
+			if err != nil {
+				// Too noisy to log
+			}
+		}
+		peerLock.Unlock()
+
+		// Then check if anybody has gone missing
+		unreachable := unreachablePlayers()
+		if len(unreachable) == 0 {
+			continue
+		}
+
+		log.Println("PartitionWorker() unreachable players", unreachable)
+		healPartition(unreachable)
+	}
+}
+
+func healPartition(unreachable []uint64) {
+	bridges, err := Server.GetBridges(NetworkSettings.UniqueUserID, unreachable, Logger)
+	if err != nil {
+		log.Println("healPartition() error getting bridges from server:", err)
+		return
+	}
+
+	peerLock.Lock()
+	addPeers(bridges)
+	peerLock.Unlock()
+
+	// Anybody the server didn't give us has left the game
+	bridged := make(map[uint64]bool)
+	for _, p := range bridges {
+		bridged[p.ClientID] = true
+	}
+
+	for _, id := range unreachable {
+		if !bridged[id] {
+			log.Println("healPartition() forgetting departed player", id)
+			dropPlayer(id)
+		}
+	}
+}
+
+// Stops showing a player that has gone away, without telling anyone it died.
+// Only a player is meant to say it has left the game; see RecordWorker. If it
+// turns up again, it is shown again.
+func dropPlayer(playerID uint64) {
+	forgetPlayer(playerID)
+	forgetPosition(playerID)
+	forgetShots(playerID)
+
+	// Only shown, never committed or sent on
+	UpdateChannel <- clientlib.DeadPlayer(playerID, 0)
+}
+
+func (*ClientListener) NotifyMembership(clientID uint64, members []uint64) error {
+	set := make(map[uint64]bool, len(members))
+	for _, id := range members {
+		set[id] = true
+	}
+
+	membership.Lock()
+	membership.peers[clientID] = peerMembership{
+		members:  set,
+		received: Clock.GetCurrentTime(),
+	}
+	membership.Unlock()
+
+	return nil
+}
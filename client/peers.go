@@ -2,6 +2,7 @@ package main
 
 import (
 	"../clientlib"
+	"../serverlib"
 	"fmt"
 	"log"
 	"net"
@@ -21,6 +22,8 @@ type ClientListener int
 
 var (
 	OutgoingUpdates = make(chan clientlib.Update, 1000)
+	// How often batches of updates are sent to peers
+	BatchInterval = DEFAULT_BATCH_INTERVAL
 )
 
 var (
@@ -32,6 +35,7 @@ const (
 	HEARTBEAT_INTERVAL       = time.Second * 1
 	HEARTBEAT_TIMEOUT        = HEARTBEAT_INTERVAL * 2
 	FAILURE_NOTIFICATION_TTL = 3 // TODO: need to decide on number
+	DEFAULT_BATCH_INTERVAL   = time.Second / 30
 )
 
 type ExistingPeerError string
@@ -40,6 +44,20 @@ func (e ExistingPeerError) Error() string {
 	return fmt.Sprintf("Client already knows peer id [%s].", string(e))
 }
 
+// Contains the ID of the peer playing on another map
+type MapMismatchError uint64
+
+func (e MapMismatchError) Error() string {
+	return fmt.Sprintf("Peer %d is playing on a different map.", uint64(e))
+}
+
+// Contains the ID of the peer that sent an update for somebody else
+type ForgedUpdateError uint64
+
+func (e ForgedUpdateError) Error() string {
+	return fmt.Sprintf("Peer %d sent an update as someone else.", uint64(e))
+}
+
 ////////////////////////////////////////////////////////////////////////////////////////////
 
 // Workers
@@ -48,13 +66,13 @@ func PeerWorker() {
 	for {
 		peerLock.Lock()
 
-		if len(peers) < MinimumPeerConnections {
-			getMorePeers()
-		}
+		// Always ask, since the server rebalances the overlay as players come
+		// and go, and may have new neighbours for us even if we have enough
+		getMorePeers()
 
 		peerLock.Unlock()
 
-		time.Sleep(5 * time.Second)
+		Clock.Sleep(5 * time.Second)
 	}
 }
 
@@ -64,6 +82,30 @@ func getMorePeers() {
 		log.Fatal("Error retrieving more peer addresses from server:", err)
 	}
 
+	addPeers(newPeers)
+	dropPeers(newPeers)
+}
+
+// Closes peers the server no longer links us to, such as when a new player
+// split the edge between us, or ones that registered with us on their own. The
+// server's overlay is what keeps everyone's degree bounded.
+// NOTE: must acquire lock before calling
+func dropPeers(listed []serverlib.PeerInfo) {
+	keep := make(map[uint64]bool, len(listed))
+	for _, p := range listed {
+		keep[p.ClientID] = true
+	}
+
+	for id := range peers {
+		if !keep[id] {
+			log.Println("Dropping peer", id, "the server unlinked us from")
+			closePeer(id)
+		}
+	}
+}
+
+// NOTE: must acquire lock before calling
+func addPeers(newPeers []serverlib.PeerInfo) {
 	for _, p := range newPeers {
 		if peers[p.ClientID] != nil || p.ClientID == NetworkSettings.UniqueUserID {
 			continue
@@ -97,12 +139,13 @@ func newPeer(id uint64, addr string, rpcAddr string) (*PeerRecord, error) {
 
 	client, err := rpc.Dial("tcp", rpcAddr)
 	if err != nil {
+		api.Close()
 		return nil, err
 	}
 	clockClient := clientlib.NewClientClockRemoteAPI(client)
 
-	if err = api.Register(NetworkSettings.UniqueUserID, LocalAddr.String(), RPCAddr.String()); err != nil {
-		conn.Close()
+	if err = api.Register(NetworkSettings.UniqueUserID, LocalAddr.String(), RPCAddr.String(), GameMap.Hash); err != nil {
+		api.Close()
 		client.Close()
 		return nil, err
 	}
@@ -111,29 +154,81 @@ func newPeer(id uint64, addr string, rpcAddr string) (*PeerRecord, error) {
 		ClientID:      id,
 		Api:           api,
 		Rpc:           clockClient,
-		LastHeartbeat: Clock.GetCurrentTime(),
+		LastHeartbeat: Clock.Now(),
 	}, nil
 }
 
 func OutgoingWorker() {
-	for {
-		update := <-OutgoingUpdates
+	var pending []clientlib.Update
 
-		peerLock.Lock()
+	ticker := Clock.NewTicker(BatchInterval)
+	defer ticker.Stop()
 
-		for _, peer := range peers {
-			if update.PlayerID == peer.ClientID {
+	for {
+		select {
+		case update := <-OutgoingUpdates:
+			pending = coalesceUpdate(pending, update)
+		case <-ticker.C():
+			if len(pending) == 0 {
 				continue
 			}
 
-			err := peer.Api.NotifyUpdate(NetworkSettings.UniqueUserID, update)
-			if err != nil {
-				// Too noisy to log
+			peerLock.Lock()
+
+			peerList := make([]*PeerRecord, 0, len(peers))
+			for _, peer := range peers {
+				peerList = append(peerList, peer)
+			}
+
+			// Work out which peers get which updates, leaving out positions
+			// they have no interest in
+			now := Clock.GetCurrentTime()
+			pruneThinned(now)
+
+			batches := make(map[uint64][]clientlib.Update)
+			for _, update := range pending {
+				for _, peer := range Dissemination.Targets(update, peerList) {
+					if interested(peer.ClientID, update, now) {
+						batches[peer.ClientID] = append(batches[peer.ClientID], update)
+					}
+				}
+			}
+
+			for id, batch := range batches {
+				err := peers[id].Api.NotifyUpdates(NetworkSettings.UniqueUserID, batch)
+				if err != nil {
+					// Too noisy to log
+				}
+
+				disseminationStats.sent(len(batch))
 			}
+
+			peerLock.Unlock()
+
+			pending = nil
 		}
+	}
+}
 
-		peerLock.Unlock()
+// Adds an update to a batch. Only the newest position of each player is kept,
+// since it makes every older one moot. It takes the place of the older one, so
+// it stays in order with whatever else the player did after it.
+func coalesceUpdate(pending []clientlib.Update, update clientlib.Update) []clientlib.Update {
+	if update.Kind == clientlib.POSITION {
+		for i, other := range pending {
+			if other.Kind != clientlib.POSITION || other.PlayerID != update.PlayerID {
+				continue
+			}
+
+			if !other.Time.After(update.Time) {
+				pending[i] = update
+			}
+			// Otherwise we already have something newer
+			return pending
+		}
 	}
+
+	return append(pending, update)
 }
 
 func ListenerWorker() {
@@ -187,7 +282,7 @@ func HeartbeatWorker(clientID uint64) {
 				break
 			}
 			log.Printf("Heartbeat() Peer %d is alive\n", clientID)
-		case <-time.After(HEARTBEAT_TIMEOUT):
+		case <-Clock.After(HEARTBEAT_TIMEOUT):
 			peerLock.Lock()
 			if _, ok := peers[clientID]; ok {
 				if err := peers[clientID].Rpc.Ping(); err != nil {
@@ -199,14 +294,14 @@ func HeartbeatWorker(clientID uint64) {
 			peerLock.Unlock()
 		}
 
-		time.Sleep(HEARTBEAT_INTERVAL)
+		Clock.Sleep(HEARTBEAT_INTERVAL)
 	}
 }
 
 func HeartbeatMonitorWorker(clientID uint64) {
-	time.Sleep(HEARTBEAT_INTERVAL) // Grace period before monitoring begins
+	Clock.Sleep(HEARTBEAT_INTERVAL) // Grace period before monitoring begins
 	for {
-		time.Sleep(HEARTBEAT_INTERVAL)
+		Clock.Sleep(HEARTBEAT_INTERVAL)
 		peerLock.Lock()
 
 		if _, ok := peers[clientID]; !ok {
@@ -214,15 +309,16 @@ func HeartbeatMonitorWorker(clientID uint64) {
 			return
 		}
 
-		if time.Since(peers[clientID].LastHeartbeat) > HEARTBEAT_TIMEOUT {
+		if heartbeatOverdue(clientID) {
 			if err := peers[clientID].Rpc.Ping(); err != nil {
 				handleDisconnection(clientID)
 				peerLock.Unlock()
 				return
 			}
 
-			peers[clientID].Api.Register(localPlayer.ID, LocalAddr.String(), RPCAddr.String())
-			peers[clientID].LastHeartbeat = Clock.GetCurrentTime()
+			// Registering waits for an answer, so don't hold the lock for it
+			go peers[clientID].Api.Register(world.Local.ID, LocalAddr.String(), RPCAddr.String(), GameMap.Hash)
+			peers[clientID].LastHeartbeat = Clock.Now()
 			peerLock.Unlock()
 			continue
 		}
@@ -232,6 +328,13 @@ func HeartbeatMonitorWorker(clientID uint64) {
 	}
 }
 
+// Whether we haven't heard a heartbeat from a peer for too long
+// NOTE: must acquire lock before calling
+func heartbeatOverdue(clientID uint64) bool {
+	peer, ok := peers[clientID]
+	return ok && Clock.Since(peer.LastHeartbeat) > HEARTBEAT_TIMEOUT
+}
+
 // NOTE: must acquire lock before calling
 func handleDisconnection(clientID uint64) {
 	log.Println("handleDisconnection()", clientID)
@@ -252,16 +355,28 @@ func handleDisconnection(clientID uint64) {
 	}
 }
 
+// Stops talking to a peer that went away. Only it can say it left the game, so
+// we stop showing it, but don't tell anyone it died.
 func removePeer(clientID uint64) (err error) {
+	if _, ok := peers[clientID]; ok {
+		err = closePeer(clientID)
+		dropPlayer(clientID)
+	}
+
+	return err
+}
+
+// Stops talking to a peer, which is still in the game
+// NOTE: must acquire lock before calling
+func closePeer(clientID uint64) (err error) {
 	if peer, ok := peers[clientID]; ok {
-		if err = peer.Api.Conn.Close(); err != nil {
-			log.Println("removePeer() error closing connection with peer", clientID)
+		if err = peer.Api.Close(); err != nil {
+			log.Println("closePeer() error closing connection with peer", clientID)
 		}
 		if err = peer.Rpc.Conn.Close(); err != nil {
-			log.Println("removePeer() error closing connection with peer", clientID)
+			log.Println("closePeer() error closing connection with peer", clientID)
 		}
 
-		RecordUpdates <- clientlib.DeadPlayer(clientID, 0).Timestamp(Clock.GetCurrentTime())
 		delete(peers, clientID)
 	}
 
@@ -273,6 +388,13 @@ func removePeer(clientID uint64) (err error) {
 // Player-to-Player API
 
 func (*ClientListener) NotifyUpdate(clientID uint64, update clientlib.Update) error {
+	if update.Hops == 0 && update.PlayerID != clientID {
+		// Straight from whoever made it, so that had better be its player.
+		// Relayed updates can't be checked like this, as they aren't signed.
+		return ForgedUpdateError(clientID)
+	}
+
+	update.Hops++
 	RecordUpdates <- update
 	return nil
 }
@@ -299,12 +421,22 @@ func (*ClientListener) NotifyFailure(clientID uint64, ttl int) error {
 	return nil
 }
 
-func (*ClientListener) Register(clientID uint64, address string, tcpAddress string) error {
+func (*ClientListener) Register(clientID uint64, address string, tcpAddress string, wire clientlib.WireVersion, mapHash uint64) error {
 	log.Println("Register()", clientID, "address", address)
 
+	if mapHash != GameMap.Hash {
+		// We'd never agree on who hit what
+		return MapMismatchError(clientID)
+	}
+
+	// It may have restarted, and will number its shots from the start again
+	forgetShots(clientID)
+
 	// Don't do anything if you already know this peer
 	peerLock.Lock()
-	if _, ok := peers[clientID]; ok {
+	if peer, ok := peers[clientID]; ok {
+		// but do talk to it in whatever it understands
+		peer.Api.SetWire(wire)
 		peerLock.Unlock()
 
 		// We already have this peer
@@ -328,13 +460,16 @@ func (*ClientListener) Register(clientID uint64, address string, tcpAddress stri
 		return err
 	}
 
+	api := clientlib.NewClientAPIRemote(conn, PeerLogger, IsLogUpdates)
+	api.SetWire(wire)
+
 	// Write down this new peer
 	peerLock.Lock()
 	peers[clientID] = &PeerRecord{
 		ClientID:      clientID,
-		Api:           clientlib.NewClientAPIRemote(conn, PeerLogger, IsLogUpdates),
+		Api:           api,
 		Rpc:           clientlib.NewClientClockRemoteAPI(client),
-		LastHeartbeat: Clock.GetCurrentTime(),
+		LastHeartbeat: Clock.Now(),
 	}
 	peerLock.Unlock()
 
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"../clocklib"
+	"testing"
+	"time"
+)
+
+// Runs the client on a fake clock until the returned function is called
+func useFakeClock() (*clocklib.FakeClock, func()) {
+	fake := clocklib.NewFakeClock(time.Unix(1000, 0))
+
+	old := Clock
+	Clock = clocklib.NewClockManager(fake)
+
+	return fake, func() { Clock = old }
+}
+
+func overdue(id uint64) bool {
+	peerLock.Lock()
+	defer peerLock.Unlock()
+
+	return heartbeatOverdue(id)
+}
+
+func TestHeartbeatTimeout(t *testing.T) {
+	fake, restore := useFakeClock()
+	defer restore()
+
+	const id = 42
+	peerLock.Lock()
+	peers[id] = &PeerRecord{ClientID: id, LastHeartbeat: Clock.Now()}
+	peerLock.Unlock()
+	defer func() {
+		peerLock.Lock()
+		delete(peers, id)
+		peerLock.Unlock()
+	}()
+
+	fake.Advance(HEARTBEAT_TIMEOUT)
+	if overdue(id) {
+		t.Fatalf("Peer timed out right at the timeout")
+	}
+
+	fake.Advance(time.Millisecond)
+	if !overdue(id) {
+		t.Fatalf("Peer didn't time out after the timeout")
+	}
+
+	var c ClockController
+	var ack bool
+	c.Heartbeat(id, &ack)
+	if overdue(id) {
+		t.Fatalf("Heartbeat didn't reset the timeout")
+	}
+
+	// Clock syncs don't count as time passing
+	Clock.SetOffset(time.Hour)
+	if overdue(id) {
+		t.Errorf("Stepping the clock forward timed the peer out")
+	}
+	Clock.SetOffset(-time.Hour)
+	fake.Advance(HEARTBEAT_TIMEOUT + time.Millisecond)
+	if !overdue(id) {
+		t.Errorf("Stepping the clock back kept the peer from timing out")
+	}
+}
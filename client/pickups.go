@@ -0,0 +1,72 @@
+package main
+
+import (
+	"../clientlib"
+	"../worldlib"
+	"fmt"
+	"github.com/faiface/pixel"
+	"github.com/faiface/pixel/imdraw"
+	"golang.org/x/image/colornames"
+	"image/color"
+)
+
+const (
+	// Position updates are only sent so often, so a player claiming a pickup
+	// may be a little further from it than it really was
+	PICKUP_TOLERANCE = worldlib.PickupRadius + 2*worldlib.PlayerHitBounds
+)
+
+// Places pickups the same way as everyone else in the room. Set once at startup.
+var PickupSeed uint64
+
+var pickupColors = map[worldlib.PickupKind]color.Color{
+	worldlib.HealthPickup: colornames.Forestgreen,
+	worldlib.SpeedPickup:  colornames.Royalblue,
+	worldlib.ShieldPickup: colornames.Gold,
+	worldlib.AmmoPickup:   colornames.Orange,
+}
+
+type BadPickupError string
+
+func (e BadPickupError) Error() string {
+	return fmt.Sprintf("Bad pickup: %s", string(e))
+}
+
+// Checks that a pickup was there to claim, and that the player claiming it was
+// on it at the time
+// NOTE: only call from RecordWorker
+func checkPickup(claim clientlib.Update) (worldlib.Pickup, error) {
+	pickup, ok := worldlib.SpawnPickup(PickupSeed, GameMap, claim.Ref)
+	if !ok || !pickup.Available(claim.Time) {
+		return pickup, BadPickupError("no such pickup then")
+	}
+
+	if claim.PlayerID == world.Local.ID {
+		// Trust our own claims
+		return pickup, nil
+	}
+
+	record, ok := records[claim.PlayerID]
+	if !ok {
+		return pickup, BadPickupError("no such player")
+	}
+
+	if record.PositionAt(claim.Time).Sub(pickup.Pos).Len() > PICKUP_TOLERANCE {
+		return pickup, BadPickupError("player wasn't there")
+	}
+
+	return pickup, nil
+}
+
+func DrawPickup(imd *imdraw.IMDraw, pickup worldlib.Pickup) {
+	imd.Color = pickupColors[pickup.Kind]
+	imd.Push(pickup.Pos)
+	imd.Circle(worldlib.PickupRadius/2, 0)
+}
+
+// Rings a tank while it has a shield up
+func DrawShield(imd *imdraw.IMDraw, pos pixel.Vec) {
+	imd.Color = pickupColors[worldlib.ShieldPickup]
+	imd.Push(pos)
+	imd.Circle(worldlib.PlayerHitBounds, 2)
+}
@@ -2,24 +2,44 @@ package main
 
 import (
 	"../clientlib"
+	"../worldlib"
 	"github.com/faiface/pixel"
 	"log"
 	"math"
+	"sync"
 	"time"
 )
 
 const (
 	TimeDelta = -1000 * time.Millisecond
+	// Holding updates as long as RecordWorker accepts them means none arrive
+	// after their turn
+	DEFAULT_HOLD_WINDOW = -TimeDelta
+	// Don't correct a player more often than this, however many bad positions
+	// it sends before the first correction gets there
+	CORRECTION_INTERVAL = 250 * time.Millisecond
 )
 
 var (
 	RecordUpdates = make(chan clientlib.Update, 1000)
+	// Accepted updates wait here until they can be committed in order
+	Events = clientlib.NewEventBuffer(DEFAULT_HOLD_WINDOW)
 )
 
 var (
-	records    = make(map[uint64]*PlayerRecord)
-	history    []clientlib.Update
-	historyMap = make(map[uint64]interface{})
+	records = make(map[uint64]*PlayerRecord)
+	// When we last corrected each player. Only touched by RecordWorker.
+	corrected = make(map[uint64]time.Time)
+	// history is written by RecordWorker, and read by anti-entropy
+	historyLock = sync.Mutex{}
+	history     []clientlib.Update
+	historyMap  = make(map[uint64]interface{})
+	// When each dead player's death was committed, so RecordWorker can tell
+	// whether a respawn is due. Written as updates are committed.
+	fallen = struct {
+		sync.Mutex
+		at map[uint64]time.Time
+	}{at: make(map[uint64]time.Time)}
 )
 
 type PlayerRecord struct {
@@ -27,6 +47,10 @@ type PlayerRecord struct {
 	Time  time.Time
 	Pos   pixel.Vec
 	Angle float64
+	// Sequence number of the input that took the player to Pos
+	Seq uint64
+	// Recent positions, oldest first, so we can tell where the player was
+	trail []clientlib.Update
 }
 
 func (r *PlayerRecord) Accept(update clientlib.Update) {
@@ -36,9 +60,98 @@ func (r *PlayerRecord) Accept(update clientlib.Update) {
 	case clientlib.POSITION:
 		r.Pos = update.Pos
 		r.Angle = update.Angle
+		r.Seq = update.Seq
+
+		// Positions can arrive out of order; keep the trail sorted
+		i := len(r.trail)
+		for i > 0 && update.Time.Before(r.trail[i-1].Time) {
+			i--
+		}
+		r.trail = append(r.trail, clientlib.Update{})
+		copy(r.trail[i+1:], r.trail[i:])
+		r.trail[i] = update
+
+		// Nothing older than this gets checked anyway
+		fence := update.Time.Add(TimeDelta)
+		for len(r.trail) > 1 && r.trail[0].Time.Before(fence) {
+			r.trail = r.trail[1:]
+		}
+	}
+}
+
+// Rewinds the player to where it was at t: the last position it sent before
+// then, or the first one we have if t is older than that
+func (r *PlayerRecord) PositionAt(t time.Time) pixel.Vec {
+	pos := r.Pos
+	for i := len(r.trail) - 1; i >= 0; i-- {
+		pos = r.trail[i].Pos
+		if !r.trail[i].Time.After(t) {
+			break
+		}
+	}
+
+	return pos
+}
+
+// Returns the nonces of the recent updates that have to make it to everyone
+func historyDigest() []uint64 {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	var nonces []uint64
+	for _, update := range history {
+		if update.IsReliable() {
+			nonces = append(nonces, update.Nonce)
+		}
 	}
+
+	return nonces
 }
 
+// Returns the recent updates that have to make it to everyone, but that aren't
+// in a peer's digest
+func historyMissing(digest []uint64) []clientlib.Update {
+	seen := make(map[uint64]bool, len(digest))
+	for _, nonce := range digest {
+		seen[nonce] = true
+	}
+
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	var missing []clientlib.Update
+	for _, update := range history {
+		if update.IsReliable() && !seen[update.Nonce] {
+			missing = append(missing, update)
+		}
+	}
+
+	return missing
+}
+
+// Tells a player we rejected its position, and where we last accepted it. It
+// goes to everyone, like any other update, and the player replays from there.
+// NOTE: only call from RecordWorker
+func correct(update clientlib.Update) {
+	record := records[update.PlayerID]
+	if record == nil || record.Seq == 0 {
+		// Nothing to go back to
+		return
+	}
+
+	now := Clock.GetCurrentTime()
+	if now.Sub(corrected[update.PlayerID]) < CORRECTION_INTERVAL {
+		return
+	}
+	corrected[update.PlayerID] = now
+
+	correction := clientlib.Correction(world.Local.ID, update.PlayerID, record.Seq, record.Pos, update.Nonce).Timestamp(now)
+
+	// RecordWorker is the one reading this channel
+	go func() { RecordUpdates <- correction }()
+}
+
+// NOTE: must hold historyLock before calling
 func pruneHistory() {
 	fence := Clock.GetCurrentTime().Add(TimeDelta)
 
@@ -69,11 +182,15 @@ func RecordWorker() {
 			continue
 		}
 
+		historyLock.Lock()
+
 		// Prune history
 		pruneHistory()
 
 		if _, exists := historyMap[update.Nonce]; exists {
 			// We've already seen this update
+			historyLock.Unlock()
+			disseminationStats.duplicate()
 			continue
 		}
 
@@ -81,14 +198,86 @@ func RecordWorker() {
 		historyMap[update.Nonce] = nil
 		history = append(history, update)
 
+		historyLock.Unlock()
+		disseminationStats.accepted(update)
+
 		// Accept the update
 		switch update.Kind {
 		case clientlib.DEAD:
+			if update.OtherPlayer != 0 {
+				// Kills only count once they're confirmed, see hits.go
+				log.Println("Ignoring unconfirmed kill")
+				continue
+			}
+
+			// What's left is players saying they've left the game. Updates
+			// aren't signed, so NotifyUpdate can only check the ones straight
+			// from their player; a peer relaying one can make it up, and
+			// everyone else will commit it. The most we can do is refuse
+			// ones about ourselves: ours never come back to us, as we've
+			// seen their nonces, so any about us are made up.
+			if update.PlayerID == world.Local.ID && update.Hops > 0 {
+				log.Println("Ignoring someone else saying we left")
+				continue
+			}
+
 			// Remove the player if it's dead
 			delete(records, update.PlayerID)
+			delete(corrected, update.PlayerID)
+			forgetShots(update.PlayerID)
+			forgetPlayer(update.PlayerID)
+			forgetPosition(update.PlayerID)
+		case clientlib.HIT:
+			// Our own claims get checked too, since they count the same
+			if err := checkClaim(update); err != nil {
+				log.Println("Rejecting hit claim:", err)
+				continue
+			}
+
+			if damage, ok := countClaim(update); ok {
+				confirmHit(damage)
+			}
+		case clientlib.DAMAGE:
+			// Damage is only ever worked out locally, from hits in hits.go
+			// and from the zone as updates are committed
+			log.Println("Ignoring damage from a peer")
+			continue
+		case clientlib.RESPAWN:
+			if !GameMap.IsSpawnPoint(update.Pos) {
+				log.Println("Ignoring respawn away from a spawn point")
+				continue
+			}
+
+			// Only the dead respawn, and not until they have waited, as in
+			// World.Commit
+			if died, dead := diedAt(update.PlayerID); !dead || update.Time.Sub(died) < worldlib.RespawnDelay {
+				log.Println("Ignoring respawn from player", update.PlayerID, "before it is due")
+				continue
+			}
+
+			// Start checking its moves afresh from the spawn point
+			records[update.PlayerID] = &PlayerRecord{
+				ID: update.PlayerID,
+			}
+			records[update.PlayerID].Accept(clientlib.Update{
+				Kind:     clientlib.POSITION,
+				PlayerID: update.PlayerID,
+				Time:     update.Time,
+				Pos:      update.Pos,
+			})
+			delete(corrected, update.PlayerID)
+			forgetRecentShots(update.PlayerID)
+			notePosition(update.PlayerID, update.Pos)
+		case clientlib.PICKUP:
+			// Ammo only counts once the claim wins, see commitUpdate
+			if _, err := checkPickup(update); err != nil {
+				log.Println("Ignoring pickup claim:", err)
+				continue
+			}
 		case clientlib.FIRE:
 			// Trust our own updates
-			if update.PlayerID == localPlayer.ID {
+			if update.PlayerID == world.Local.ID {
+				rememberShot(update)
 				break
 			}
 
@@ -110,9 +299,24 @@ func RecordWorker() {
 				log.Println("Ignoring bad shot")
 				continue
 			}
+
+			if GameMap.Crosses(playerPos, update.Pos) {
+				log.Println("Ignoring shot through a wall")
+				continue
+			}
+
+			if err := checkFire(update); err != nil {
+				log.Println("Ignoring shot:", err)
+				continue
+			}
+
+			rememberShot(update)
 		case clientlib.POSITION:
-			if !windowCfg.Bounds.Contains(update.Pos) {
-				// ignore positions that are outside the screen
+			if !GameMap.Bounds().Contains(update.Pos) {
+				// ignore positions that are outside the world
+				if update.PlayerID != world.Local.ID {
+					correct(update)
+				}
 				continue
 			}
 
@@ -122,7 +326,7 @@ func RecordWorker() {
 				records[update.PlayerID] = &PlayerRecord{
 					ID: update.PlayerID,
 				}
-			} else if update.PlayerID != localPlayer.ID {
+			} else if update.PlayerID != world.Local.ID {
 				// Trust our own updates without checking them
 				// check that this new position is reasonable
 				last := records[update.PlayerID].Pos
@@ -131,18 +335,66 @@ func RecordWorker() {
 
 				if distance > 10*clientlib.PlayerSpeed*dt {
 					log.Println("Ignoring bad position")
+					correct(update)
+					continue
+				}
+
+				// Tanks can't drive into walls. Whether it went through one
+				// can't be told from here, as it may have gone around it
+				// between the updates we got.
+				if GameMap.Blocked(update.Pos, 0) {
+					log.Println("Ignoring position in a wall")
+					correct(update)
+					continue
+				}
+
+				// Others extrapolate along this, so it has to be believable
+				if update.Vel.Len() > 2*clientlib.PlayerSpeed {
+					log.Println("Ignoring bad velocity")
+					correct(update)
 					continue
 				}
 			}
 
 			// Otherwise update its record with whatever came in
 			records[update.PlayerID].Accept(update)
+			notePosition(update.PlayerID, update.Pos)
+		}
+
+		if update.Kind != clientlib.DEAD {
+			heardFrom(update.PlayerID)
 		}
 
-		// Display the update
+		// Display the update right away, and settle it once it's in order
 		UpdateChannel <- update
+		if !Events.Push(update) {
+			log.Println("Update arrived too late to be ordered, dropping it")
+		}
 
-		// Send the update out
-		OutgoingUpdates <- update
+		// Send the update out, if it should go any further
+		if Dissemination.ShouldForward(update) {
+			OutgoingUpdates <- update
+		}
 	}
 }
+
+func noteDeath(playerID uint64, t time.Time) {
+	fallen.Lock()
+	fallen.at[playerID] = t
+	fallen.Unlock()
+}
+
+func noteRespawn(playerID uint64) {
+	fallen.Lock()
+	delete(fallen.at, playerID)
+	fallen.Unlock()
+}
+
+// When a player's death was committed, if it is dead
+func diedAt(playerID uint64) (time.Time, bool) {
+	fallen.Lock()
+	defer fallen.Unlock()
+
+	t, ok := fallen.at[playerID]
+	return t, ok
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"../clientlib"
+	"testing"
+	"time"
+)
+
+func TestPruneHistory(t *testing.T) {
+	fake, restore := useFakeClock()
+	defer restore()
+
+	now := Clock.GetCurrentTime()
+	old := clientlib.Update{Kind: clientlib.FIRE, Nonce: 1, Time: now}
+	recent := clientlib.Update{Kind: clientlib.FIRE, Nonce: 2, Time: now.Add(-TimeDelta / 2)}
+
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	history = []clientlib.Update{old, recent}
+	historyMap = map[uint64]interface{}{old.Nonce: nil, recent.Nonce: nil}
+	defer func() {
+		history = nil
+		historyMap = make(map[uint64]interface{})
+	}()
+
+	pruneHistory()
+	if len(history) != 2 {
+		t.Fatalf("Pruned updates that weren't old yet, %d left", len(history))
+	}
+
+	fake.Advance(-TimeDelta + time.Millisecond)
+	pruneHistory()
+	if len(history) != 1 || history[0].Nonce != recent.Nonce {
+		t.Fatalf("Expected only the recent update left, got %+v", history)
+	}
+	if _, ok := historyMap[old.Nonce]; ok {
+		t.Errorf("Pruned update is still in the map")
+	}
+
+	fake.Advance(-TimeDelta)
+	pruneHistory()
+	if len(history) != 0 || len(historyMap) != 0 {
+		t.Errorf("Expected everything pruned, got %+v", history)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"../clientlib"
+	"../worldlib"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Fire-rate and ammo checks. A player can't fire again until its weapon has
+// cooled down, and can't fire more shots than the weapon's magazine holds
+// without stopping long enough to reload in between. Shots can come in out of
+// order, so each one is checked against the shots either side of it.
+//
+// Picking up ammo fills every magazine, so shots after a committed ammo pickup
+// start a new run.
+//
+// Shots are numbered, and how far each strays comes from its number, so a
+// player could skip numbers to pick where its shots go. Skipped numbers count
+// as shots fired, so skipping takes as long as firing them would have.
+
+const (
+	// How much faster than its weapon allows a player may seem to fire, to
+	// allow for clocks that aren't quite in sync
+	FIRE_RATE_TOLERANCE = 0.9
+)
+
+var (
+	// Recent shots from each player, oldest first, and the highest numbered
+	// shot from each. Checked by RecordWorker, and forgotten wherever players
+	// go away or come back.
+	firingLock = sync.Mutex{}
+	firing     = make(map[uint64][]clientlib.Update)
+	lastShots  = make(map[uint64]clientlib.Update)
+	// When each player picked up ammo lately, oldest first. Written as
+	// pickups are committed.
+	rearmed = struct {
+		sync.Mutex
+		at map[uint64][]time.Time
+	}{at: make(map[uint64][]time.Time)}
+)
+
+type BadShotError string
+
+func (e BadShotError) Error() string {
+	return fmt.Sprintf("Bad shot: %s", string(e))
+}
+
+// Checks a shot against the player's other recent shots, and remembers it if
+// it passes
+// NOTE: only call from RecordWorker
+func checkFire(shot clientlib.Update) error {
+	weapon, err := worldlib.WeaponFor(shot.Weapon)
+	if err != nil {
+		return err
+	}
+
+	firingLock.Lock()
+	defer firingLock.Unlock()
+
+	// Longer than any magazine takes to empty and reload. A player quiet for
+	// this long may have restarted, and be numbering its shots afresh.
+	fence := Clock.GetCurrentTime().Add(-SHOT_MEMORY)
+	for id, last := range lastShots {
+		if last.Time.Before(fence) {
+			delete(lastShots, id)
+		}
+	}
+
+	shots := firing[shot.PlayerID]
+	for len(shots) > 0 && shots[0].Time.Before(fence) {
+		shots = shots[1:]
+	}
+
+	i := len(shots)
+	for i > 0 && shot.Time.Before(shots[i-1].Time) {
+		i--
+	}
+
+	cooldown := func(s clientlib.Update) float64 {
+		w, _ := worldlib.WeaponFor(s.Weapon)
+		return w.Cooldown.Seconds() * FIRE_RATE_TOLERANCE
+	}
+
+	// How long it takes to fire a shot, and any skipped before it
+	since := func(s clientlib.Update, last clientlib.Update) float64 {
+		return cooldown(s) + float64(s.Seq-last.Seq-1)*fastestCooldown()*FIRE_RATE_TOLERANCE
+	}
+
+	last, ok := lastShots[shot.PlayerID]
+	ok = ok && last.Time.Before(shot.Time)
+	if i > 0 {
+		last, ok = shots[i-1], true
+	}
+	if ok && shot.Seq <= last.Seq {
+		return BadShotError("shot numbered before the last shot")
+	}
+	if ok && shot.Time.Sub(last.Time).Seconds() < since(shot, last) {
+		return BadShotError("fired too soon after the last shot")
+	}
+	if i < len(shots) && shots[i].Seq <= shot.Seq {
+		return BadShotError("shot numbered after the next shot")
+	}
+	if i < len(shots) && shots[i].Time.Sub(shot.Time).Seconds() < since(shots[i], shot) {
+		return BadShotError("fired too soon before the next shot")
+	}
+
+	// Count the shots from this weapon with no time to reload between them
+	run := 1
+	for j, last := i-1, shot.Time; j >= 0; j-- {
+		if shots[j].Weapon != shot.Weapon {
+			continue
+		}
+		if last.Sub(shots[j].Time) >= weapon.Reload || rearmedBetween(shot.PlayerID, shots[j].Time, last) {
+			break
+		}
+		run, last = run+1, shots[j].Time
+	}
+	for j, last := i, shot.Time; j < len(shots); j++ {
+		if shots[j].Weapon != shot.Weapon {
+			continue
+		}
+		if shots[j].Time.Sub(last) >= weapon.Reload || rearmedBetween(shot.PlayerID, last, shots[j].Time) {
+			break
+		}
+		run, last = run+1, shots[j].Time
+	}
+
+	if run > weapon.Magazine {
+		return BadShotError("out of ammo")
+	}
+
+	shots = append(shots, clientlib.Update{})
+	copy(shots[i+1:], shots[i:])
+	shots[i] = shot
+	firing[shot.PlayerID] = shots
+
+	if shot.Seq > lastShots[shot.PlayerID].Seq {
+		lastShots[shot.PlayerID] = shot
+	}
+
+	return nil
+}
+
+// Forgets a player's recent shots, as when it respawns with full magazines
+func forgetRecentShots(playerID uint64) {
+	firingLock.Lock()
+	delete(firing, playerID)
+	firingLock.Unlock()
+}
+
+// Forgets everything about a player's shots, so it can number them afresh
+// when it comes back
+func forgetShots(playerID uint64) {
+	firingLock.Lock()
+	delete(firing, playerID)
+	delete(lastShots, playerID)
+	firingLock.Unlock()
+}
+
+func noteRearm(playerID uint64, t time.Time) {
+	rearmed.Lock()
+	defer rearmed.Unlock()
+
+	// Runs of shots are never checked further back than this
+	times := rearmed.at[playerID]
+	for len(times) > 0 && t.Sub(times[0]) > SHOT_MEMORY {
+		times = times[1:]
+	}
+	rearmed.at[playerID] = append(times, t)
+}
+
+// Whether a player picked up ammo after from, and by to
+func rearmedBetween(playerID uint64, from time.Time, to time.Time) bool {
+	rearmed.Lock()
+	defer rearmed.Unlock()
+
+	for _, t := range rearmed.at[playerID] {
+		if t.After(from) && !t.After(to) {
+			return true
+		}
+	}
+	return false
+}
+
+// The shortest cooldown of any weapon, in seconds
+func fastestCooldown() float64 {
+	fastest := worldlib.Weapons[0].Cooldown
+	for _, weapon := range worldlib.Weapons {
+		if weapon.Cooldown < fastest {
+			fastest = weapon.Cooldown
+		}
+	}
+
+	return fastest.Seconds()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"../clientlib"
+	"../worldlib"
+	"github.com/faiface/pixel"
+	"testing"
+	"time"
+)
+
+func shotAt(seq uint64, t time.Time) clientlib.Update {
+	shot := clientlib.FireBullet(7, pixel.ZV, 0, worldlib.Cannon).Timestamp(t)
+	shot.Seq = seq
+	return shot
+}
+
+func TestShotNumbers(t *testing.T) {
+	fake, restore := useFakeClock()
+	defer restore()
+	defer delete(firing, 7)
+	defer delete(lastShots, 7)
+
+	now := Clock.GetCurrentTime()
+	cooldown := worldlib.Weapons[worldlib.Cannon].Cooldown
+
+	if err := checkFire(shotAt(1, now)); err != nil {
+		t.Fatalf("First shot rejected: %v", err)
+	}
+	if err := checkFire(shotAt(1, now.Add(cooldown))); err == nil {
+		t.Errorf("Accepted a shot reusing a number")
+	}
+	if err := checkFire(shotAt(5, now.Add(cooldown))); err == nil {
+		t.Errorf("Accepted a shot skipping numbers it had no time to fire")
+	}
+	if err := checkFire(shotAt(2, now.Add(cooldown))); err != nil {
+		t.Errorf("Next shot rejected: %v", err)
+	}
+
+	// Long enough to have fired the skipped shots with the fastest weapon
+	later := now.Add(cooldown + cooldown + 3*worldlib.Weapons[worldlib.MachineGun].Cooldown)
+	if err := checkFire(shotAt(6, later)); err != nil {
+		t.Errorf("Shot after skipping what it had time to fire rejected: %v", err)
+	}
+
+	// Shots no longer recent still count for a while
+	forgetRecentShots(7)
+	if err := checkFire(shotAt(6, later.Add(time.Minute))); err == nil {
+		t.Errorf("Accepted a reused number once the shot was no longer recent")
+	}
+
+	// A player that restarts and registers again numbers its shots afresh
+	forgetShots(7)
+	if err := checkFire(shotAt(1, later.Add(time.Minute))); err != nil {
+		t.Errorf("First shot after registering again rejected: %v", err)
+	}
+
+	// As does one that crashed and was quiet for long enough, even if nobody
+	// noticed it go
+	fake.Advance(2*time.Minute + SHOT_MEMORY)
+	if err := checkFire(shotAt(1, Clock.GetCurrentTime())); err != nil {
+		t.Errorf("First shot after restarting rejected: %v", err)
+	}
+}
+
+func TestAmmoPickupRefillsMagazine(t *testing.T) {
+	_, restore := useFakeClock()
+	defer restore()
+	defer delete(firing, 7)
+	defer delete(lastShots, 7)
+
+	now := Clock.GetCurrentTime()
+	cannon := worldlib.Weapons[worldlib.Cannon]
+
+	var seq uint64
+	fire := func() error {
+		seq++
+		return checkFire(shotAt(seq, now.Add(time.Duration(seq)*cannon.Cooldown)))
+	}
+
+	for i := 0; i < cannon.Magazine; i++ {
+		if err := fire(); err != nil {
+			t.Fatalf("Shot %d rejected: %v", seq, err)
+		}
+	}
+	if err := fire(); err == nil {
+		t.Fatalf("Accepted more shots than the magazine holds")
+	}
+
+	// The rejected shot's number was never used, so take it again
+	seq--
+	noteRearm(7, now.Add(time.Duration(seq)*cannon.Cooldown+cannon.Cooldown/2))
+	defer func() {
+		rearmed.Lock()
+		delete(rearmed.at, 7)
+		rearmed.Unlock()
+	}()
+
+	if err := fire(); err != nil {
+		t.Errorf("Shot after picking up ammo rejected: %v", err)
+	}
+}
@@ -1,11 +1,27 @@
 package clientlib
 
 import (
+	"../clocklib"
 	"fmt"
 	"github.com/DistributedClocks/GoVector/govec"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+const (
+	// How long Register waits to hear whether the other end took us
+	REGISTER_TIMEOUT = RETRANSMIT_INTERVAL * (MAX_RETRANSMITS + 1)
+	// How long to wait before listening again after a failed read. Reads fail
+	// straight away while the other end is down, so this keeps us from spinning.
+	RECEIVE_BACKOFF = 50 * time.Millisecond
+)
+
+// Where the library gets the time for retransmissions, reassembly and RPC
+// timeouts. Tests can swap in a clocklib.FakeClock.
+var Clock clocklib.Clock = clocklib.RealClock{}
+
 type PeerNetSettings struct {
 	UniqueUserID uint64
 
@@ -15,13 +31,23 @@ type PeerNetSettings struct {
 type ClientAPI interface {
 	NotifyUpdate(clientID uint64, update Update) error
 	NotifyFailure(clientID uint64, ttl int) error
-	Register(clientID uint64, address string, tcpAddress string) error
+	Register(clientID uint64, address string, tcpAddress string, wire WireVersion, mapHash uint64) error
+	NotifyDigest(clientID uint64, nonces []uint64, wantReply bool) error
+	NotifyMembership(clientID uint64, members []uint64) error
 }
 
 type ClientAPIRemote struct {
 	Conn         *net.UDPConn
 	Logger       *govec.GoLog
 	IsLogUpdates bool
+	reliable     *reliableSender
+	reassembler  *Reassembler
+	closed       chan struct{}
+	closeOnce    sync.Once
+	// Replies to REGISTER, which are the only messages that get one
+	replies chan ClientReply
+	// Wire version to send with, agreed on with the other end
+	wire uint32
 }
 
 type ClientAPIError string
@@ -31,41 +57,102 @@ func (e ClientAPIError) Error() string {
 }
 
 func NewClientAPIRemote(conn *net.UDPConn, logger *govec.GoLog, logUpdates bool) *ClientAPIRemote {
-	return &ClientAPIRemote{
+	a := &ClientAPIRemote{
 		Conn:         conn,
 		Logger:       logger,
 		IsLogUpdates: logUpdates,
+		reliable:     newReliableSender(),
+		reassembler:  NewReassembler(),
+		closed:       make(chan struct{}),
+		replies:      make(chan ClientReply, 1),
 	}
+
+	go a.ackWorker()
+	go a.retransmitWorker()
+
+	return a
 }
 
-func (a *ClientAPIRemote) doAPICall(msg ClientMessage) error {
-	// Send our message
-	err := SendMessage(a.Conn, nil, &msg, a.Logger, a.IsLogUpdates)
-	if err != nil {
-		return err
-	}
+// Sets the wire version to send with. Use the newer of what both ends understand.
+func (a *ClientAPIRemote) SetWire(wire WireVersion) {
+	atomic.StoreUint32(&a.wire, uint32(MinWireVersion(wire, WIRE_LATEST)))
+}
 
-	// Wait for a reply
-	var reply ClientReply
-	_, err = ReceiveMessage(a.Conn, &reply, a.Logger, a.IsLogUpdates)
-	if err != nil {
-		return err
+func (a *ClientAPIRemote) Wire() WireVersion {
+	return WireVersion(atomic.LoadUint32(&a.wire))
+}
+
+// Stops retransmitting and closes the connection. Only the first call does
+// anything.
+func (a *ClientAPIRemote) Close() error {
+	var err error
+	a.closeOnce.Do(func() {
+		close(a.closed)
+		err = a.Conn.Close()
+	})
+	return err
+}
+
+func (a *ClientAPIRemote) ackWorker() {
+	for {
+		var reply ClientReply
+		_, _, err := ReceiveMessage(a.Conn, a.reassembler, &reply, a.Logger, a.IsLogUpdates)
+		if err != nil {
+			select {
+			case <-a.closed:
+				return
+			case <-Clock.After(RECEIVE_BACKOFF):
+				// The other end may not be up yet, keep listening
+				continue
+			}
+		}
+
+		switch reply.Kind {
+		case ACK:
+			a.reliable.ack(reply.Seq)
+		case OKAY, ERROR:
+			select {
+			case a.replies <- reply:
+			default:
+				// Nobody is waiting for it
+			}
+		}
+
+		// Every reply says what the other end understands
+		a.SetWire(reply.Wire)
 	}
+}
+
+func (a *ClientAPIRemote) retransmitWorker() {
+	ticker := Clock.NewTicker(RETRANSMIT_INTERVAL / 2)
+	defer ticker.Stop()
 
-	// Return an error if one occurred
-	switch reply.Kind {
-	case OKAY:
-		return nil
-	case ERROR:
-		return ClientAPIError(reply.Error)
+	for {
+		select {
+		case <-a.closed:
+			return
+		case now := <-ticker.C():
+			for _, msg := range a.reliable.due(now) {
+				// Errors here are retried on the next tick
+				SendMessage(a.Conn, nil, &msg, a.Wire(), a.Logger, a.IsLogUpdates)
+			}
+		}
 	}
+}
+
+// Sends a message the other end has to receive. It is retransmitted until acked.
+func (a *ClientAPIRemote) doAPICallReliable(msg ClientMessage) error {
+	msg = a.reliable.track(msg)
 
-	panic("Unreachable")
+	// If this fails, retransmission will take care of it
+	SendMessage(a.Conn, nil, &msg, a.Wire(), a.Logger, a.IsLogUpdates)
+
+	return nil
 }
 
 func (a *ClientAPIRemote) doAPICallAsync(msg ClientMessage) error {
 	// Send our message
-	err := SendMessage(a.Conn, nil, &msg, a.Logger, a.IsLogUpdates)
+	err := SendMessage(a.Conn, nil, &msg, a.Wire(), a.Logger, a.IsLogUpdates)
 	if err != nil {
 		return err
 	}
@@ -75,28 +162,118 @@ func (a *ClientAPIRemote) doAPICallAsync(msg ClientMessage) error {
 }
 
 func (a *ClientAPIRemote) NotifyUpdate(clientID uint64, update Update) error {
-	return a.doAPICallAsync(ClientMessage{
+	msg := ClientMessage{
 		Kind:     UPDATE,
 		ClientID: clientID,
 		Update:   update,
+	}
+
+	if msg.IsReliable() {
+		return a.doAPICallReliable(msg)
+	}
+
+	return a.doAPICallAsync(msg)
+}
+
+// Sends many updates at once. Updates that have to make it are sent reliably in
+// one message, and the rest unreliably in another.
+func (a *ClientAPIRemote) NotifyUpdates(clientID uint64, updates []Update) error {
+	var reliable, unreliable []Update
+	for _, update := range updates {
+		if update.IsReliable() {
+			reliable = append(reliable, update)
+		} else {
+			unreliable = append(unreliable, update)
+		}
+	}
+
+	var err error
+	if len(reliable) > 0 {
+		err = a.doAPICallReliable(ClientMessage{
+			Kind:     BATCH,
+			ClientID: clientID,
+			Updates:  reliable,
+		})
+	}
+
+	if len(unreliable) > 0 {
+		if e := a.doAPICallAsync(ClientMessage{
+			Kind:     BATCH,
+			ClientID: clientID,
+			Updates:  unreliable,
+		}); e != nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+// Tells the other end which updates we have seen, so it can send us what we're
+// missing. If wantReply is set, it sends us its own digest back.
+func (a *ClientAPIRemote) NotifyDigest(clientID uint64, nonces []uint64, wantReply bool) error {
+	ttl := 0
+	if wantReply {
+		ttl = 1
+	}
+
+	return a.doAPICallAsync(ClientMessage{
+		Kind:     DIGEST,
+		ClientID: clientID,
+		Nonces:   nonces,
+		Ttl:      ttl,
 	})
 }
 
-func (a *ClientAPIRemote) NotifyFailure(clientID uint64, ttl int) error {
+// Tells the other end which players we can currently hear from
+func (a *ClientAPIRemote) NotifyMembership(clientID uint64, members []uint64) error {
 	return a.doAPICallAsync(ClientMessage{
+		Kind:     MEMBERSHIP,
+		ClientID: clientID,
+		Members:  members,
+	})
+}
+
+func (a *ClientAPIRemote) NotifyFailure(clientID uint64, ttl int) error {
+	return a.doAPICallReliable(ClientMessage{
 		Kind:     FAILURE,
 		ClientID: clientID,
 		Ttl:      ttl,
 	})
 }
 
-func (a *ClientAPIRemote) Register(clientID uint64, address string, tcpAddress string) error {
-	return a.doAPICallAsync(ClientMessage{
+// Registers with the other end, which turns us down if we aren't playing on the
+// same map. If it doesn't answer in time, we carry on as if it took us; it will
+// still get the message, and can still turn us down then.
+func (a *ClientAPIRemote) Register(clientID uint64, address string, tcpAddress string, mapHash uint64) error {
+	// Forget any answer to an earlier attempt
+	select {
+	case <-a.replies:
+	default:
+	}
+
+	err := a.doAPICallReliable(ClientMessage{
 		Kind:       REGISTER,
 		ClientID:   clientID,
 		Address:    address,
 		TcpAddress: tcpAddress,
+		Wire:       WIRE_LATEST,
+		MapHash:    mapHash,
 	})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case reply := <-a.replies:
+		if reply.Kind == ERROR {
+			return ClientAPIError(reply.Error)
+		}
+	case <-Clock.After(REGISTER_TIMEOUT):
+	case <-a.closed:
+	}
+
+	return nil
 }
 
 type ClientAPIListener struct {
@@ -104,6 +281,8 @@ type ClientAPIListener struct {
 	conn         *net.UDPConn
 	Logger       *govec.GoLog
 	IsLogUpdates bool
+	reliable     *reliableReceiver
+	reassembler  *Reassembler
 }
 
 func NewClientAPIListener(table ClientAPI, conn *net.UDPConn, logger *govec.GoLog, logUpdates bool) *ClientAPIListener {
@@ -112,31 +291,74 @@ func NewClientAPIListener(table ClientAPI, conn *net.UDPConn, logger *govec.GoLo
 		conn:         conn,
 		Logger:       logger,
 		IsLogUpdates: logUpdates,
+		reliable:     newReliableReceiver(),
+		reassembler:  NewReassembler(),
 	}
 }
 
 func (l *ClientAPIListener) Accept() error {
 	// Receive a message and who it came from
 	var msg ClientMessage
-	addr, err := ReceiveMessage(l.conn, &msg, l.Logger, l.IsLogUpdates)
+	addr, wire, err := ReceiveMessage(l.conn, l.reassembler, &msg, l.Logger, l.IsLogUpdates)
 	if err != nil {
 		return err
 	}
 
+	if msg.Seq == 0 {
+		return l.process(addr, wire, msg)
+	}
+
+	// Ack reliable messages we have kept, even if we've seen them before
+	ready, keep := l.reliable.receive(addr, msg, Clock.Now())
+	if keep {
+		ack := ClientReply{
+			Kind: ACK,
+			Seq:  msg.Seq,
+			Wire: WIRE_LATEST,
+		}
+		// If this fails, the sender will send it again, and we ack it then
+		err = SendMessage(l.conn, addr, &ack, wire, l.Logger, l.IsLogUpdates)
+	}
+
+	// Then process whatever is now in order
+	for _, msg := range ready {
+		if e := l.process(addr, wire, msg); e != nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+// Processes a message, replying with the same wire version it came in with
+func (l *ClientAPIListener) process(addr *net.UDPAddr, wire WireVersion, msg ClientMessage) (err error) {
 	// Process the message
 	switch msg.Kind {
 	case UPDATE:
 		// NotifyUpdate doesn't need a response
 		return l.table.NotifyUpdate(msg.ClientID, msg.Update)
+	case BATCH:
+		// Neither does a batch of them
+		for _, update := range msg.Updates {
+			if e := l.table.NotifyUpdate(msg.ClientID, update); e != nil {
+				err = e
+			}
+		}
+		return err
 	case FAILURE:
 		return l.table.NotifyFailure(msg.ClientID, msg.Ttl)
+	case DIGEST:
+		return l.table.NotifyDigest(msg.ClientID, msg.Nonces, msg.Ttl > 0)
+	case MEMBERSHIP:
+		return l.table.NotifyMembership(msg.ClientID, msg.Members)
 	case REGISTER:
-		err = l.table.Register(msg.ClientID, msg.Address, msg.TcpAddress)
+		err = l.table.Register(msg.ClientID, msg.Address, msg.TcpAddress, msg.Wire, msg.MapHash)
 	}
 
 	// Send a reply
 	reply := ClientReply{
 		Kind: OKAY,
+		Wire: WIRE_LATEST,
 	}
 
 	if err != nil {
@@ -146,5 +368,5 @@ func (l *ClientAPIListener) Accept() error {
 	}
 
 	// Send the reply message
-	return SendMessage(l.conn, addr, &reply, l.Logger, l.IsLogUpdates)
+	return SendMessage(l.conn, addr, &reply, wire, l.Logger, l.IsLogUpdates)
 }
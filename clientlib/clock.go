@@ -4,6 +4,7 @@ import (
 	"../crdtlib"
 	"github.com/DistributedClocks/GoVector/govec"
 	"net/rpc"
+	"sort"
 	"time"
 )
 
@@ -17,6 +18,7 @@ type ClientClockAPI interface {
 	// -----------------------------------------------------------------------------
 	TimeRequest() (time.Time, error)
 	SetOffset(offset time.Duration) error
+	AdjustOffset(delta time.Duration) error
 	Heartbeat(clientID uint64) error
 	Recover() (bool, error)
 	Ping() error
@@ -29,6 +31,15 @@ type ClientClockRemote struct {
 const (
 	TIMEOUT              = 20 * time.Second
 	CONNECTIVITY_TIMEOUT = 1 * time.Second
+	// Clock samples that take longer than this are useless anyway
+	CLOCK_TIMEOUT = 2 * time.Second
+)
+
+const (
+	CLOCK_SAMPLES    = 8
+	CLOCK_SAMPLE_GAP = 20 * time.Millisecond
+	// Samples with a round trip longer than this many times the best one are outliers
+	CLOCK_RTT_FILTER = 2
 )
 
 type GetTimeRequest struct {
@@ -50,6 +61,11 @@ type SetOffsetResponse struct {
 	B   []byte
 }
 
+type AdjustOffsetRequest struct {
+	Delta time.Duration
+	B     []byte
+}
+
 type KVClientGetRequest struct {
 	Key uint64
 	B   []byte
@@ -70,6 +86,13 @@ type KVClientPutResponse struct {
 	B   []byte
 }
 
+// An estimate of how far ahead of us another clock is
+type ClockSample struct {
+	Offset time.Duration
+	// Round trip time of the best sample, which bounds the error at half of it
+	RTT time.Duration
+}
+
 type DisconnectedError string
 
 func (e DisconnectedError) Error() string {
@@ -80,12 +103,63 @@ func NewClientClockRemoteAPI(api *rpc.Client) *ClientClockRemote {
 	return &ClientClockRemote{api}
 }
 
+// Estimates how far ahead of now() a remote clock is. It is sampled several
+// times; samples with a long round trip are thrown out since their offset
+// estimate is poor, and the rest are averaged.
+func SampleClock(c *ClientClockRemote, now func() time.Time, logger *govec.GoLog) (ClockSample, error) {
+	var samples []ClockSample
+
+	for i := 0; i < CLOCK_SAMPLES; i++ {
+		if i > 0 {
+			Clock.Sleep(CLOCK_SAMPLE_GAP)
+		}
+
+		before := now()
+		t, err := c.TimeRequest(logger)
+		if err != nil {
+			// A slow sample is just a bad one; keep whatever else we get
+			continue
+		}
+		after := now()
+
+		rtt := after.Sub(before)
+		remoteTime := t.Add(rtt / 2)
+		samples = append(samples, ClockSample{
+			Offset: remoteTime.Sub(after),
+			RTT:    rtt,
+		})
+	}
+
+	if len(samples) == 0 {
+		return ClockSample{}, DisconnectedError("")
+	}
+
+	// Average everything that isn't much slower than the best sample
+	sort.Slice(samples, func(i, j int) bool { return samples[i].RTT < samples[j].RTT })
+	best := samples[0]
+
+	var total time.Duration
+	var n time.Duration
+	for _, sample := range samples {
+		if sample.RTT > best.RTT*CLOCK_RTT_FILTER {
+			break
+		}
+		total += sample.Offset
+		n++
+	}
+
+	return ClockSample{
+		Offset: total / n,
+		RTT:    best.RTT,
+	}, nil
+}
+
 func (c *ClientClockRemote) doApiCall(call string, request interface{}, response interface{}, timeout time.Duration) error {
 	channel := c.Conn.Go(call, request, response, nil)
 	select {
 	case channel := <-channel.Done:
 		return channel.Error
-	case <-time.After(timeout):
+	case <-Clock.After(timeout):
 		return DisconnectedError("")
 	}
 }
@@ -95,13 +169,13 @@ func (c *ClientClockRemote) doApiCall(call string, request interface{}, response
 // KV: Get and Put functions.
 
 func (c *ClientClockRemote) KVClientGet(key uint64, logger *govec.GoLog) (crdtlib.ValueType, error) {
-	value := crdtlib.ValueType{0, 0}
+	value := crdtlib.ValueType{0, 0, 0}
 	var response KVClientGetResponse
 	b := logger.PrepareSend("[KVClientGet] requesting from client", key)
 	request := KVClientGetRequest{key, b}
 	if err := c.doApiCall("ClockController.KVClientGet", &request, &response, TIMEOUT); err != nil {
 		logger.UnpackReceive("[KVClientGet] request from client failed", response.B, &value)
-		return crdtlib.ValueType{0, 0}, nil
+		return crdtlib.ValueType{0, 0, 0}, nil
 	}
 
 	logger.UnpackReceive("[KVClientGet] request from client succeeded", response.B, &value)
@@ -131,7 +205,7 @@ func (c *ClientClockRemote) TimeRequest(logger *govec.GoLog) (time.Time, error)
 	var response GetTimeResponse
 	b := logger.PrepareSend("[TimeRequest] sending command to client", 0)
 	request := GetTimeRequest{b}
-	if err := c.doApiCall("ClockController.TimeRequest", &request, &response, TIMEOUT); err != nil {
+	if err := c.doApiCall("ClockController.TimeRequest", &request, &response, CLOCK_TIMEOUT); err != nil {
 		logger.UnpackReceive("[TimeRequest] command failed", response.B, &t)
 		return time.Time{}, err
 	}
@@ -154,6 +228,20 @@ func (c *ClientClockRemote) SetOffset(offset time.Duration, logger *govec.GoLog)
 	return nil
 }
 
+func (c *ClientClockRemote) AdjustOffset(delta time.Duration, logger *govec.GoLog) error {
+	var ack bool
+	var response SetOffsetResponse
+	b := logger.PrepareSend("[AdjustOffset] sending command to client", delta)
+	request := AdjustOffsetRequest{delta, b}
+	if err := c.doApiCall("ClockController.AdjustOffset", &request, &response, CLOCK_TIMEOUT); err != nil {
+		logger.UnpackReceive("[AdjustOffset] command failed", response.B, &ack)
+		return err
+	}
+
+	logger.UnpackReceive("[AdjustOffset] command succeeded", response.B, &ack)
+	return nil
+}
+
 func (c *ClientClockRemote) Heartbeat(clientID uint64) error {
 	request := clientID
 	var ack bool
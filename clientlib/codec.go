@@ -0,0 +1,338 @@
+package clientlib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"github.com/DistributedClocks/GoVector/govec"
+	"math"
+	"time"
+)
+
+// Every message starts with a byte naming how the rest of it is encoded. gob is
+// always understood; the binary codec is only used once both ends have said
+// they support it at REGISTER time.
+//
+// Any change to the binary layout gets a new version, which becomes
+// WIRE_LATEST. Each end sends with the older of its own WIRE_LATEST and the
+// other end's, so a peer that doesn't know a layout gets one it does, or gob.
+
+type WireVersion byte
+
+const (
+	// gob, or GoVector's encoding when logging updates
+	WIRE_GOB WireVersion = iota
+	// Fixed layout binary encoding, with every field below
+	WIRE_BINARY
+
+	WIRE_LATEST = WIRE_BINARY
+)
+
+// Contains the wire version
+type UnknownWireVersionError byte
+
+func (e UnknownWireVersionError) Error() string {
+	return fmt.Sprintf("Unknown wire version %d", byte(e))
+}
+
+// Contains a description of what was wrong
+type MalformedMessageError string
+
+func (e MalformedMessageError) Error() string {
+	return fmt.Sprintf("Malformed message: %s", string(e))
+}
+
+// Returns the newest wire version that both ends understand
+func MinWireVersion(a, b WireVersion) WireVersion {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+func encodeMessage(msg interface{}, wire WireVersion, logger *govec.GoLog, logUpdates bool) ([]byte, error) {
+	if logUpdates {
+		// GoVector needs to wrap the message to attach its vector clock
+		return append([]byte{byte(WIRE_GOB)}, logger.PrepareSend("[SendMessage] sending message to peer", msg)...), nil
+	}
+
+	if wire == WIRE_BINARY {
+		w := wireWriter{buf: []byte{byte(wire)}}
+
+		switch m := msg.(type) {
+		case *ClientMessage:
+			w.clientMessage(m)
+			return w.buf, nil
+		case *ClientReply:
+			w.clientReply(m)
+			return w.buf, nil
+		}
+
+		// Anything else falls back to gob
+	}
+
+	bufBytes := bytes.NewBuffer([]byte{byte(WIRE_GOB)})
+	if err := gob.NewEncoder(bufBytes).Encode(msg); err != nil {
+		return nil, err
+	}
+
+	return bufBytes.Bytes(), nil
+}
+
+func decodeMessage(buf []byte, msg interface{}, logger *govec.GoLog, logUpdates bool) (WireVersion, error) {
+	if len(buf) == 0 {
+		return WIRE_GOB, MalformedMessageError("empty message")
+	}
+
+	wire, body := WireVersion(buf[0]), buf[1:]
+
+	switch wire {
+	case WIRE_GOB:
+		if logUpdates {
+			logger.UnpackReceive("[ReceiveMessage] received message from peer", body, msg)
+			return wire, nil
+		}
+
+		return wire, gob.NewDecoder(bytes.NewReader(body)).Decode(msg)
+	case WIRE_BINARY:
+		r := wireReader{buf: body}
+
+		switch m := msg.(type) {
+		case *ClientMessage:
+			r.clientMessage(m)
+		case *ClientReply:
+			r.clientReply(m)
+		default:
+			return wire, MalformedMessageError(fmt.Sprintf("can't decode %T", msg))
+		}
+
+		return wire, r.err
+	}
+
+	return wire, UnknownWireVersionError(wire)
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+
+// Binary layout, all big endian:
+//
+//	ClientMessage: kind (1) | client ID (8) | seq (8) | ttl (4) | wire (1) |
+//	               address (string) | tcp address (string) | update |
+//	               update count (2) | updates | nonce count (2) | nonces |
+//	               member count (2) | members | map hash (8)
+//	ClientReply:   kind (1) | seq (8) | wire (1) | error (string)
+//	Update:        kind (1) | time (8) | nonce (8) | player ID (8) |
+//	               other player (8) | pos x (8) | pos y (8) | angle (8) |
+//	               hops (1) | ref (8) | vel x (8) | vel y (8) | seq (8) |
+//	               damage (4) | weapon (1)
+//	string:        length (2) | bytes
+
+type wireWriter struct {
+	buf []byte
+}
+
+func (w *wireWriter) u8(v byte) {
+	w.buf = append(w.buf, v)
+}
+
+func (w *wireWriter) u16(v uint16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	w.buf = append(w.buf, b[:]...)
+}
+
+func (w *wireWriter) u32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.buf = append(w.buf, b[:]...)
+}
+
+func (w *wireWriter) u64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	w.buf = append(w.buf, b[:]...)
+}
+
+func (w *wireWriter) f64(v float64) {
+	w.u64(math.Float64bits(v))
+}
+
+func (w *wireWriter) time(t time.Time) {
+	if t.IsZero() {
+		w.u64(0)
+	} else {
+		w.u64(uint64(t.UnixNano()))
+	}
+}
+
+func (w *wireWriter) str(s string) {
+	w.u16(uint16(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *wireWriter) ids(ids []uint64) {
+	w.u16(uint16(len(ids)))
+	for _, id := range ids {
+		w.u64(id)
+	}
+}
+
+func (w *wireWriter) update(u *Update) {
+	w.u8(byte(u.Kind))
+	w.time(u.Time)
+	w.u64(u.Nonce)
+	w.u64(u.PlayerID)
+	w.u64(u.OtherPlayer)
+	w.f64(u.Pos.X)
+	w.f64(u.Pos.Y)
+	w.f64(u.Angle)
+	w.u8(byte(u.Hops))
+	w.u64(u.Ref)
+	w.f64(u.Vel.X)
+	w.f64(u.Vel.Y)
+	w.u64(u.Seq)
+	w.u32(uint32(int32(u.Damage)))
+	w.u8(byte(u.Weapon))
+}
+
+func (w *wireWriter) clientMessage(m *ClientMessage) {
+	w.u8(byte(m.Kind))
+	w.u64(m.ClientID)
+	w.u64(m.Seq)
+	w.u32(uint32(int32(m.Ttl)))
+	w.u8(byte(m.Wire))
+	w.str(m.Address)
+	w.str(m.TcpAddress)
+	w.update(&m.Update)
+	w.u16(uint16(len(m.Updates)))
+	for i := range m.Updates {
+		w.update(&m.Updates[i])
+	}
+	w.ids(m.Nonces)
+	w.ids(m.Members)
+	w.u64(m.MapHash)
+}
+
+func (w *wireWriter) clientReply(m *ClientReply) {
+	w.u8(byte(m.Kind))
+	w.u64(m.Seq)
+	w.u8(byte(m.Wire))
+	w.str(m.Error)
+}
+
+// Reads values in order, remembering the first error. Reads after an error
+// return zero values.
+type wireReader struct {
+	buf []byte
+	err error
+}
+
+func (r *wireReader) next(n int) []byte {
+	if r.err != nil {
+		return make([]byte, n)
+	}
+
+	if len(r.buf) < n {
+		r.err = MalformedMessageError("message too short")
+		return make([]byte, n)
+	}
+
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *wireReader) u8() byte {
+	return r.next(1)[0]
+}
+
+func (r *wireReader) u16() uint16 {
+	return binary.BigEndian.Uint16(r.next(2))
+}
+
+func (r *wireReader) u32() uint32 {
+	return binary.BigEndian.Uint32(r.next(4))
+}
+
+func (r *wireReader) u64() uint64 {
+	return binary.BigEndian.Uint64(r.next(8))
+}
+
+func (r *wireReader) f64() float64 {
+	return math.Float64frombits(r.u64())
+}
+
+func (r *wireReader) time() time.Time {
+	nanos := r.u64()
+	if nanos == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, int64(nanos))
+}
+
+func (r *wireReader) str() string {
+	n := r.u16()
+	return string(r.next(int(n)))
+}
+
+func (r *wireReader) ids() []uint64 {
+	n := int(r.u16())
+	if n == 0 {
+		return nil
+	}
+
+	ids := make([]uint64, n)
+	for i := range ids {
+		ids[i] = r.u64()
+	}
+
+	return ids
+}
+
+func (r *wireReader) update(u *Update) {
+	u.Kind = UpdateKind(r.u8())
+	u.Time = r.time()
+	u.Nonce = r.u64()
+	u.PlayerID = r.u64()
+	u.OtherPlayer = r.u64()
+	u.Pos.X = r.f64()
+	u.Pos.Y = r.f64()
+	u.Angle = r.f64()
+	u.Hops = int(r.u8())
+	u.Ref = r.u64()
+	u.Vel.X = r.f64()
+	u.Vel.Y = r.f64()
+	u.Seq = r.u64()
+	u.Damage = int(int32(r.u32()))
+	u.Weapon = int(r.u8())
+}
+
+func (r *wireReader) clientMessage(m *ClientMessage) {
+	m.Kind = ClientMessageKind(r.u8())
+	m.ClientID = r.u64()
+	m.Seq = r.u64()
+	m.Ttl = int(int32(r.u32()))
+	m.Wire = WireVersion(r.u8())
+	m.Address = r.str()
+	m.TcpAddress = r.str()
+	r.update(&m.Update)
+	if n := int(r.u16()); n > 0 {
+		m.Updates = make([]Update, n)
+		for i := range m.Updates {
+			r.update(&m.Updates[i])
+		}
+	}
+	m.Nonces = r.ids()
+	m.Members = r.ids()
+	m.MapHash = r.u64()
+}
+
+func (r *wireReader) clientReply(m *ClientReply) {
+	m.Kind = ClientReplyKind(r.u8())
+	m.Seq = r.u64()
+	m.Wire = WireVersion(r.u8())
+	m.Error = r.str()
+}
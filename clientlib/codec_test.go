@@ -0,0 +1,146 @@
+package clientlib
+
+import (
+	"github.com/faiface/pixel"
+	"testing"
+	"time"
+)
+
+func sameUpdate(a Update, b Update) bool {
+	if !a.Time.Equal(b.Time) {
+		return false
+	}
+
+	a.Time, b.Time = time.Time{}, time.Time{}
+	return a == b
+}
+
+func sameIDs(a []uint64, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sameMessage(a ClientMessage, b ClientMessage) bool {
+	if len(a.Updates) != len(b.Updates) {
+		return false
+	}
+	for i := range a.Updates {
+		if !sameUpdate(a.Updates[i], b.Updates[i]) {
+			return false
+		}
+	}
+
+	return a.Kind == b.Kind && a.ClientID == b.ClientID && sameUpdate(a.Update, b.Update) &&
+		sameIDs(a.Nonces, b.Nonces) && sameIDs(a.Members, b.Members) &&
+		a.Address == b.Address && a.TcpAddress == b.TcpAddress && a.Ttl == b.Ttl &&
+		a.Seq == b.Seq && a.Wire == b.Wire && a.MapHash == b.MapHash
+}
+
+var fullUpdate = Update{
+	Kind:        DAMAGE,
+	Time:        time.Unix(1000, 123456789),
+	Nonce:       1<<63 + 5,
+	PlayerID:    42,
+	OtherPlayer: 7,
+	Pos:         pixel.V(-12.5, 3e9),
+	Vel:         pixel.V(150, -0.25),
+	Angle:       -3.1,
+	Hops:        3,
+	Ref:         99,
+	Seq:         1 << 40,
+	Damage:      -10,
+	Weapon:      2,
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	messages := []struct {
+		name string
+		msg  ClientMessage
+	}{
+		{"empty", ClientMessage{}},
+		{"update", ClientMessage{Kind: UPDATE, ClientID: 1, Update: fullUpdate, Seq: 3}},
+		{"batch", ClientMessage{Kind: BATCH, ClientID: 2, Updates: []Update{fullUpdate, {Kind: POSITION, Pos: pixel.V(1, 2)}}}},
+		{"register", ClientMessage{Kind: REGISTER, ClientID: 3, Address: "127.0.0.1:1234", TcpAddress: "[::1]:5678", Wire: WIRE_LATEST, MapHash: 0xDEADBEEF}},
+		{"digest", ClientMessage{Kind: DIGEST, ClientID: 4, Nonces: []uint64{1, 2, 1 << 63}, Ttl: -1}},
+		{"membership", ClientMessage{Kind: MEMBERSHIP, ClientID: 5, Members: []uint64{9, 8}}},
+	}
+
+	replies := []ClientReply{
+		{Kind: OKAY, Wire: WIRE_LATEST},
+		{Kind: ERROR, Error: "no such map"},
+		{Kind: ACK, Seq: 77},
+	}
+
+	for _, wire := range []WireVersion{WIRE_GOB, WIRE_BINARY} {
+		for _, test := range messages {
+			buf, err := encodeMessage(&test.msg, wire, nil, false)
+			if err != nil {
+				t.Fatalf("wire %d, %s: encoding failed: %v", wire, test.name, err)
+			}
+
+			var decoded ClientMessage
+			got, err := decodeMessage(buf, &decoded, nil, false)
+			if err != nil || got != wire {
+				t.Errorf("wire %d, %s: decoded as wire %d, error %v", wire, test.name, got, err)
+			}
+			if !sameMessage(test.msg, decoded) {
+				t.Errorf("wire %d, %s: got %+v back, expected %+v", wire, test.name, decoded, test.msg)
+			}
+		}
+
+		for _, reply := range replies {
+			buf, err := encodeMessage(&reply, wire, nil, false)
+			if err != nil {
+				t.Fatalf("wire %d: encoding %+v failed: %v", wire, reply, err)
+			}
+
+			var decoded ClientReply
+			if _, err := decodeMessage(buf, &decoded, nil, false); err != nil || decoded != reply {
+				t.Errorf("wire %d: got %+v back, expected %+v, error %v", wire, decoded, reply, err)
+			}
+		}
+	}
+}
+
+func TestCodecRejectsBadMessages(t *testing.T) {
+	full, err := encodeMessage(&ClientMessage{Kind: UPDATE, Update: fullUpdate}, WIRE_BINARY, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{"empty", nil},
+		{"truncated", full[:len(full)/2]},
+		{"unknown wire version", append([]byte{byte(WIRE_LATEST + 1)}, full[1:]...)},
+	}
+
+	for _, test := range tests {
+		var msg ClientMessage
+		_, err := decodeMessage(test.buf, &msg, nil, false)
+
+		switch err.(type) {
+		case MalformedMessageError, UnknownWireVersionError:
+		default:
+			t.Errorf("%s: expected the message to be rejected, got error %v", test.name, err)
+		}
+	}
+}
+
+func TestWireNegotiation(t *testing.T) {
+	if MinWireVersion(WIRE_GOB, WIRE_LATEST) != WIRE_GOB || MinWireVersion(WIRE_LATEST, WIRE_GOB) != WIRE_GOB {
+		t.Errorf("Peers that only know gob aren't sent gob")
+	}
+	if MinWireVersion(WIRE_LATEST+1, WIRE_LATEST) != WIRE_LATEST {
+		t.Errorf("Newer peers aren't sent what we know")
+	}
+}
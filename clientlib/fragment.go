@@ -0,0 +1,198 @@
+package clientlib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Messages are split into fragments that each fit in a single datagram. Every
+// datagram starts with a header saying which message it belongs to, and where in
+// that message it goes.
+//
+//	| message ID (4) | index (1) | count (1) | payload ... |
+
+const (
+	MAX_DATAGRAM_SIZE    = 0x400
+	FRAGMENT_HEADER_SIZE = 6
+	MAX_FRAGMENT_PAYLOAD = MAX_DATAGRAM_SIZE - FRAGMENT_HEADER_SIZE
+	MAX_FRAGMENTS        = 0xff
+	MAX_MESSAGE_SIZE     = MAX_FRAGMENT_PAYLOAD * MAX_FRAGMENTS
+	// How long to wait for the rest of a message before giving up on it
+	FRAGMENT_TIMEOUT = 2 * time.Second
+)
+
+// Contains the size of the message
+type MessageTooLargeError int
+
+func (e MessageTooLargeError) Error() string {
+	return fmt.Sprintf("Message of %d bytes is larger than the maximum of %d bytes", int(e), MAX_MESSAGE_SIZE)
+}
+
+// Contains the sender and message ID
+type ReassemblyTimeoutError string
+
+func (e ReassemblyTimeoutError) Error() string {
+	return fmt.Sprintf("Timed out reassembling message [%s]", string(e))
+}
+
+// Contains a description of what was wrong
+type MalformedFragmentError string
+
+func (e MalformedFragmentError) Error() string {
+	return fmt.Sprintf("Malformed fragment: %s", string(e))
+}
+
+var nextMessageID = rand.Uint32()
+
+// Splits an encoded message into datagrams
+func fragment(buf []byte) ([][]byte, error) {
+	if len(buf) > MAX_MESSAGE_SIZE {
+		return nil, MessageTooLargeError(len(buf))
+	}
+
+	count := (len(buf) + MAX_FRAGMENT_PAYLOAD - 1) / MAX_FRAGMENT_PAYLOAD
+	if count == 0 {
+		count = 1
+	}
+
+	id := atomic.AddUint32(&nextMessageID, 1)
+
+	datagrams := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		start := i * MAX_FRAGMENT_PAYLOAD
+		end := start + MAX_FRAGMENT_PAYLOAD
+		if end > len(buf) {
+			end = len(buf)
+		}
+
+		datagram := make([]byte, FRAGMENT_HEADER_SIZE, FRAGMENT_HEADER_SIZE+end-start)
+		binary.BigEndian.PutUint32(datagram[0:4], id)
+		datagram[4] = byte(i)
+		datagram[5] = byte(count)
+		datagrams = append(datagrams, append(datagram, buf[start:end]...))
+	}
+
+	return datagrams, nil
+}
+
+type partialMessage struct {
+	fragments [][]byte
+	received  int
+	started   time.Time
+}
+
+// Puts fragmented messages back together. Safe to use from many goroutines.
+type Reassembler struct {
+	lock    sync.Mutex
+	partial map[string]*partialMessage
+}
+
+func NewReassembler() *Reassembler {
+	return &Reassembler{
+		partial: make(map[string]*partialMessage),
+	}
+}
+
+// Adds a datagram from addr. Returns the whole message once every fragment of
+// it has arrived, or nil if it is still incomplete.
+func (r *Reassembler) Add(addr *net.UDPAddr, datagram []byte, now time.Time) ([]byte, error) {
+	if len(datagram) < FRAGMENT_HEADER_SIZE {
+		return nil, MalformedFragmentError("datagram shorter than header")
+	}
+
+	id := binary.BigEndian.Uint32(datagram[0:4])
+	index, count := int(datagram[4]), int(datagram[5])
+	payload := datagram[FRAGMENT_HEADER_SIZE:]
+
+	if count == 0 || index >= count {
+		return nil, MalformedFragmentError(fmt.Sprintf("fragment %d of %d", index, count))
+	}
+
+	if count == 1 {
+		// The common case, nothing to put together
+		return payload, nil
+	}
+
+	key := fmt.Sprintf("%s/%d", addr, id)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	p, ok := r.partial[key]
+	if !ok {
+		p = &partialMessage{
+			fragments: make([][]byte, count),
+			started:   now,
+		}
+		r.partial[key] = p
+	}
+
+	if len(p.fragments) != count {
+		delete(r.partial, key)
+		return nil, MalformedFragmentError(fmt.Sprintf("fragment count changed for message %s", key))
+	}
+
+	if p.fragments[index] == nil {
+		// Copy, since the caller reuses its buffer
+		p.fragments[index] = append([]byte(nil), payload...)
+		p.received++
+	}
+
+	if p.received < count {
+		return nil, nil
+	}
+
+	delete(r.partial, key)
+
+	var buf []byte
+	for _, f := range p.fragments {
+		buf = append(buf, f...)
+	}
+
+	return buf, nil
+}
+
+// Drops messages that have been waiting too long for their fragments, and
+// returns an error naming them if there were any.
+func (r *Reassembler) Expire(now time.Time) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var err error
+	for key, p := range r.partial {
+		if now.Sub(p.started) > FRAGMENT_TIMEOUT {
+			delete(r.partial, key)
+			err = ReassemblyTimeoutError(key)
+		}
+	}
+
+	return err
+}
+
+// How long until the oldest incomplete message expires, or false if there are
+// none
+func (r *Reassembler) NextExpiry(now time.Time) (time.Duration, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var next time.Duration
+	found := false
+	for _, p := range r.partial {
+		wait := p.started.Add(FRAGMENT_TIMEOUT).Sub(now)
+		if !found || wait < next {
+			next, found = wait, true
+		}
+	}
+
+	if found && next <= 0 {
+		// Expire only drops messages past the timeout, so wake up just after
+		next = time.Millisecond
+	}
+
+	return next, found
+}
@@ -0,0 +1,152 @@
+package clientlib
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func message(size int) []byte {
+	buf := make([]byte, size)
+	for i := range buf {
+		buf[i] = byte(i * 7)
+	}
+	return buf
+}
+
+func TestFragmentRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		// Which order the fragments arrive in, all of them in order if nil
+		order []int
+		// Fragments that arrive twice
+		duplicate bool
+		fragments int
+	}{
+		{name: "empty", size: 0, fragments: 1},
+		{name: "one fragment", size: 100, fragments: 1},
+		{name: "exactly one fragment", size: MAX_FRAGMENT_PAYLOAD, fragments: 1},
+		{name: "two fragments", size: MAX_FRAGMENT_PAYLOAD + 1, fragments: 2},
+		{name: "out of order", size: 3 * MAX_FRAGMENT_PAYLOAD, order: []int{2, 0, 1}, fragments: 3},
+		{name: "duplicates", size: 2*MAX_FRAGMENT_PAYLOAD + 10, duplicate: true, fragments: 3},
+		{name: "largest", size: MAX_MESSAGE_SIZE, fragments: MAX_FRAGMENTS},
+	}
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	for _, test := range tests {
+		buf := message(test.size)
+		datagrams, err := fragment(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if len(datagrams) != test.fragments {
+			t.Errorf("%s: split into %d fragments, expected %d", test.name, len(datagrams), test.fragments)
+		}
+		for i, datagram := range datagrams {
+			if len(datagram) > MAX_DATAGRAM_SIZE {
+				t.Errorf("%s: fragment %d is %d bytes", test.name, i, len(datagram))
+			}
+		}
+
+		order := test.order
+		if order == nil {
+			for i := range datagrams {
+				order = append(order, i)
+			}
+		}
+
+		r := NewReassembler()
+		var out []byte
+		for n, i := range order {
+			got, err := r.Add(addr, datagrams[i], start)
+			if err != nil {
+				t.Fatalf("%s: fragment %d: %v", test.name, i, err)
+			}
+			if got != nil && n != len(order)-1 {
+				t.Errorf("%s: message came out before its last fragment", test.name)
+			}
+			out = got
+
+			if test.duplicate && n != len(order)-1 {
+				if got, _ := r.Add(addr, datagrams[i], start); got != nil {
+					t.Errorf("%s: a duplicate fragment completed the message", test.name)
+				}
+			}
+		}
+
+		if !bytes.Equal(out, buf) || out == nil {
+			t.Errorf("%s: reassembled %d bytes, not the %d sent", test.name, len(out), len(buf))
+		}
+	}
+}
+
+func TestFragmentTooLarge(t *testing.T) {
+	if _, err := fragment(message(MAX_MESSAGE_SIZE + 1)); err == nil {
+		t.Errorf("Split a message larger than the maximum")
+	}
+}
+
+func TestMalformedFragments(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+
+	tests := []struct {
+		name     string
+		datagram []byte
+	}{
+		{"shorter than header", []byte{0, 0, 0, 1, 0}},
+		{"no fragments", []byte{0, 0, 0, 1, 0, 0}},
+		{"index past count", []byte{0, 0, 0, 1, 2, 2, 'x'}},
+	}
+
+	for _, test := range tests {
+		if _, err := NewReassembler().Add(addr, test.datagram, start); err == nil {
+			t.Errorf("%s: accepted a malformed fragment", test.name)
+		}
+	}
+}
+
+func TestFragmentExpiry(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5678}
+
+	datagrams, err := fragment(message(2 * MAX_FRAGMENT_PAYLOAD))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReassembler()
+	if _, ok := r.NextExpiry(start); ok {
+		t.Errorf("Nothing is waiting, but something expires")
+	}
+
+	r.Add(addr, datagrams[0], start)
+
+	// The same message ID from someone else is a different message
+	if got, _ := r.Add(other, datagrams[1], start); got != nil {
+		t.Errorf("Fragments from two senders were put together")
+	}
+
+	if wait, ok := r.NextExpiry(start.Add(time.Second)); !ok || wait != FRAGMENT_TIMEOUT-time.Second {
+		t.Errorf("Expected the next expiry in %v, got %v", FRAGMENT_TIMEOUT-time.Second, wait)
+	}
+	if err := r.Expire(start.Add(FRAGMENT_TIMEOUT)); err != nil {
+		t.Errorf("Expired a message before its time: %v", err)
+	}
+	if wait, ok := r.NextExpiry(start.Add(FRAGMENT_TIMEOUT)); !ok || wait <= 0 {
+		t.Errorf("Expected to wake up just after the timeout, got %v", wait)
+	}
+
+	if _, ok := r.Expire(start.Add(FRAGMENT_TIMEOUT + time.Millisecond)).(ReassemblyTimeoutError); !ok {
+		t.Errorf("Expected a timeout once the rest didn't come")
+	}
+	if _, ok := r.NextExpiry(start.Add(FRAGMENT_TIMEOUT + time.Millisecond)); ok {
+		t.Errorf("Expired messages still expire")
+	}
+
+	// The rest turning up late starts over rather than completing it
+	if got, _ := r.Add(addr, datagrams[1], start.Add(FRAGMENT_TIMEOUT+time.Second)); got != nil {
+		t.Errorf("Completed a message that had expired")
+	}
+}
@@ -0,0 +1,87 @@
+package clientlib
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Holds updates back for a while so that every client applies them in the same
+// order: by timestamp, with the nonce breaking ties. An update is released once
+// it is older than the hold window, by which time anything that happened before
+// it should have arrived too.
+type EventBuffer struct {
+	lock    sync.Mutex
+	hold    time.Duration
+	pending eventHeap
+	// The last update released; anything before it is too late
+	last     Update
+	released bool
+}
+
+func NewEventBuffer(hold time.Duration) *EventBuffer {
+	return &EventBuffer{hold: hold}
+}
+
+// Adds an update to the buffer. Returns false if its turn has already passed,
+// in which case it is dropped, since applying it now would put it out of order.
+func (b *EventBuffer) Push(update Update) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.released && update.Before(b.last) {
+		return false
+	}
+
+	heap.Push(&b.pending, update)
+	return true
+}
+
+// Returns the updates that have been held long enough, in order
+func (b *EventBuffer) Release(now time.Time) []Update {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	fence := now.Add(-b.hold)
+
+	var out []Update
+	for len(b.pending) > 0 && !b.pending[0].Time.After(fence) {
+		update := heap.Pop(&b.pending).(Update)
+		out = append(out, update)
+
+		b.last = update
+		b.released = true
+	}
+
+	return out
+}
+
+// How long updates are held; nothing from before now minus this can still be pushed
+func (b *EventBuffer) Hold() time.Duration {
+	return b.hold
+}
+
+func (b *EventBuffer) Len() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return len(b.pending)
+}
+
+type eventHeap []Update
+
+func (h eventHeap) Len() int           { return len(h) }
+func (h eventHeap) Less(i, j int) bool { return h[i].Before(h[j]) }
+func (h eventHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *eventHeap) Push(x interface{}) {
+	*h = append(*h, x.(Update))
+}
+
+func (h *eventHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
@@ -0,0 +1,186 @@
+package clientlib
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A reliability layer for critical messages sent over UDP. Each ClientAPIRemote
+// numbers its reliable messages and retransmits them until the other end acks
+// them; each ClientAPIListener delivers them once and in order per sender.
+
+const (
+	RETRANSMIT_INTERVAL = 200 * time.Millisecond
+	MAX_RETRANSMITS     = 10
+	// How long a receiver waits for a missing message before giving up on it
+	REORDER_TIMEOUT = RETRANSMIT_INTERVAL * (MAX_RETRANSMITS + 1)
+	// How many out of order messages a receiver keeps per sender
+	REORDER_WINDOW = 256
+	// How long a receiver remembers a sender it has stopped hearing from
+	STREAM_IDLE_TIMEOUT = time.Minute
+)
+
+type pendingMessage struct {
+	msg   ClientMessage
+	sent  time.Time
+	tries int
+}
+
+type reliableSender struct {
+	lock    sync.Mutex
+	nextSeq uint64
+	pending map[uint64]*pendingMessage
+}
+
+func newReliableSender() *reliableSender {
+	return &reliableSender{
+		nextSeq: 1,
+		pending: make(map[uint64]*pendingMessage),
+	}
+}
+
+// Numbers a message and remembers it until it is acked
+func (s *reliableSender) track(msg ClientMessage) ClientMessage {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	msg.Seq = s.nextSeq
+	s.nextSeq++
+
+	s.pending[msg.Seq] = &pendingMessage{
+		msg:  msg,
+		sent: Clock.Now(),
+	}
+
+	return msg
+}
+
+func (s *reliableSender) ack(seq uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.pending, seq)
+}
+
+// Returns the messages that are due to be sent again, oldest first. Messages
+// that have been retransmitted too many times are dropped.
+func (s *reliableSender) due(now time.Time) []ClientMessage {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var msgs []ClientMessage
+	for seq, p := range s.pending {
+		if now.Sub(p.sent) < RETRANSMIT_INTERVAL {
+			continue
+		}
+
+		if p.tries >= MAX_RETRANSMITS {
+			delete(s.pending, seq)
+			continue
+		}
+
+		p.tries++
+		p.sent = now
+		msgs = append(msgs, p.msg)
+	}
+
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Seq < msgs[j].Seq })
+
+	return msgs
+}
+
+type reliableStream struct {
+	expected uint64
+	buffered map[uint64]ClientMessage
+	// When we first noticed a gap in the sequence
+	gapSince time.Time
+	// When we last heard anything from the sender
+	lastHeard time.Time
+}
+
+func newReliableStream() *reliableStream {
+	return &reliableStream{
+		expected: 1,
+		buffered: make(map[uint64]ClientMessage),
+	}
+}
+
+type reliableReceiver struct {
+	streams map[string]*reliableStream
+}
+
+func newReliableReceiver() *reliableReceiver {
+	return &reliableReceiver{
+		streams: make(map[string]*reliableStream),
+	}
+}
+
+// Accepts a reliable message from addr, and returns every message from addr that
+// can now be delivered in order. Duplicates produce nothing. Also returns
+// whether the message should be acked: it shouldn't if it was too far ahead to
+// keep, so the sender tries again later.
+func (r *reliableReceiver) receive(addr *net.UDPAddr, msg ClientMessage, now time.Time) ([]ClientMessage, bool) {
+	r.prune(now)
+
+	stream, ok := r.streams[addr.String()]
+	if ok && msg.Seq == 1 && (msg.Kind == REGISTER || now.Sub(stream.lastHeard) > REORDER_TIMEOUT) {
+		// A sender starting over on the same address, as after a restart. It
+		// can't be an old copy of its first message, as it would have given up
+		// on that by now, or registers again anyway.
+		ok = false
+	}
+	if !ok {
+		stream = newReliableStream()
+		r.streams[addr.String()] = stream
+	}
+	stream.lastHeard = now
+
+	if msg.Seq >= stream.expected+REORDER_WINDOW {
+		return nil, false
+	}
+	if msg.Seq >= stream.expected {
+		stream.buffered[msg.Seq] = msg
+	}
+
+	var out []ClientMessage
+	out = stream.drain(out)
+
+	if len(stream.buffered) == 0 {
+		stream.gapSince = time.Time{}
+	} else if stream.gapSince.IsZero() {
+		stream.gapSince = now
+	} else if now.Sub(stream.gapSince) > REORDER_TIMEOUT {
+		// The sender gave up on whatever is missing, so skip over it
+		for len(stream.buffered) > 0 {
+			stream.expected++
+			out = stream.drain(out)
+		}
+		stream.gapSince = time.Time{}
+	}
+
+	return out, true
+}
+
+// Forgets senders we haven't heard from in a while
+func (r *reliableReceiver) prune(now time.Time) {
+	for addr, stream := range r.streams {
+		if now.Sub(stream.lastHeard) > STREAM_IDLE_TIMEOUT {
+			delete(r.streams, addr)
+		}
+	}
+}
+
+func (s *reliableStream) drain(out []ClientMessage) []ClientMessage {
+	for {
+		msg, ok := s.buffered[s.expected]
+		if !ok {
+			return out
+		}
+
+		delete(s.buffered, s.expected)
+		s.expected++
+		out = append(out, msg)
+	}
+}
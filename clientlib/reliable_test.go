@@ -0,0 +1,107 @@
+package clientlib
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+var start = time.Unix(1000, 0)
+
+func seqs(msgs []ClientMessage) []uint64 {
+	var out []uint64
+	for _, msg := range msgs {
+		out = append(out, msg.Seq)
+	}
+	return out
+}
+
+func sameSeqs(a []uint64, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestReliableDelivery(t *testing.T) {
+	type arrival struct {
+		seq uint64
+		// UPDATE unless it says otherwise
+		kind ClientMessageKind
+		// How long after the last one it arrives
+		after time.Duration
+		// What should be delivered, and whether it should be acked
+		delivered []uint64
+		acked     bool
+	}
+
+	tests := []struct {
+		name     string
+		arrivals []arrival
+	}{
+		{"in order", []arrival{
+			{seq: 1, delivered: []uint64{1}, acked: true},
+			{seq: 2, delivered: []uint64{2}, acked: true},
+		}},
+		{"out of order", []arrival{
+			{seq: 2, acked: true},
+			{seq: 3, acked: true},
+			{seq: 1, delivered: []uint64{1, 2, 3}, acked: true},
+		}},
+		{"duplicates are acked but only delivered once", []arrival{
+			{seq: 1, delivered: []uint64{1}, acked: true},
+			{seq: 1, acked: true},
+			{seq: 3, acked: true},
+			{seq: 3, acked: true},
+			{seq: 2, delivered: []uint64{2, 3}, acked: true},
+		}},
+		{"too far ahead to keep isn't acked", []arrival{
+			{seq: REORDER_WINDOW + 1, acked: false},
+			{seq: REORDER_WINDOW, acked: true},
+		}},
+		{"gaps are skipped once the sender gives up", []arrival{
+			{seq: 2, acked: true},
+			{seq: 3, after: REORDER_TIMEOUT / 2, acked: true},
+			{seq: 4, after: REORDER_TIMEOUT, delivered: []uint64{2, 3, 4}, acked: true},
+			{seq: 1, acked: true},
+		}},
+		{"a sender registering again starts over", []arrival{
+			{seq: 1, delivered: []uint64{1}, acked: true},
+			{seq: 2, delivered: []uint64{2}, acked: true},
+			{seq: 1, kind: REGISTER, delivered: []uint64{1}, acked: true},
+			{seq: 2, delivered: []uint64{2}, acked: true},
+		}},
+		{"a sender quiet for long enough starts over", []arrival{
+			{seq: 1, delivered: []uint64{1}, acked: true},
+			{seq: 2, delivered: []uint64{2}, acked: true},
+			{seq: 1, after: REORDER_TIMEOUT / 2, acked: true},
+			{seq: 1, after: 2 * REORDER_TIMEOUT, delivered: []uint64{1}, acked: true},
+		}},
+		{"idle senders are forgotten", []arrival{
+			{seq: 1, delivered: []uint64{1}, acked: true},
+			{seq: 2, after: STREAM_IDLE_TIMEOUT + time.Second, acked: true},
+			{seq: 1, delivered: []uint64{1, 2}, acked: true},
+		}},
+	}
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	for _, test := range tests {
+		r := newReliableReceiver()
+		now := start
+
+		for i, a := range test.arrivals {
+			now = now.Add(a.after)
+			delivered, acked := r.receive(addr, ClientMessage{Kind: a.kind, Seq: a.seq}, now)
+
+			if !sameSeqs(seqs(delivered), a.delivered) || acked != a.acked {
+				t.Errorf("%s: arrival %d (seq %d) delivered %v acked %v, expected %v acked %v",
+					test.name, i, a.seq, seqs(delivered), acked, a.delivered, a.acked)
+			}
+		}
+	}
+}
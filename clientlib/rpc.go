@@ -1,24 +1,36 @@
 package clientlib
 
 import (
-	"bytes"
-	"encoding/gob"
 	"github.com/DistributedClocks/GoVector/govec"
 	"net"
+	"time"
 )
 
 type ClientMessage struct {
 	Kind       ClientMessageKind
 	ClientID   uint64
 	Update     Update
+	Updates    []Update
+	Nonces     []uint64
+	Members    []uint64
 	Address    string
 	TcpAddress string
 	Ttl        int
+	// Sequence number for messages sent reliably, zero otherwise
+	Seq uint64
+	// Newest wire version the sender understands, sent with REGISTER
+	Wire WireVersion
+	// Hash of the map the sender is playing on, sent with REGISTER
+	MapHash uint64
 }
 
 type ClientReply struct {
 	Kind  ClientReplyKind
 	Error string
+	// Sequence number being acknowledged
+	Seq uint64
+	// Newest wire version the sender understands
+	Wire WireVersion
 }
 
 type ClientMessageKind int
@@ -27,56 +39,117 @@ type ClientReplyKind int
 const (
 	OKAY ClientReplyKind = iota
 	ERROR
+	ACK
 )
 
 const (
 	UPDATE ClientMessageKind = iota
 	FAILURE
 	REGISTER
+	BATCH
+	DIGEST
+	MEMBERSHIP
 )
 
+// Whether this message has to make it to the other end
+func (m ClientMessage) IsReliable() bool {
+	switch m.Kind {
+	case UPDATE:
+		return m.Update.IsReliable()
+	case BATCH:
+		for _, update := range m.Updates {
+			if update.IsReliable() {
+				return true
+			}
+		}
+		return false
+	case DIGEST, MEMBERSHIP:
+		// These are sent periodically anyway
+		return false
+	}
+
+	return true
+}
+
 // We have to do a dance because UDP is packet based, and gob expects a stream based protocol
 
 // Sends a message using conn, optionally to addr. If addr is null, whatever the remote
-// end of conn is receives the message.
-func SendMessage(conn *net.UDPConn, addr *net.UDPAddr, msg interface{}, logger *govec.GoLog, logUpdates bool) error {
-	buf := make([]byte, 0x400)
-	if logUpdates {
-		buf = logger.PrepareSend("[SendMessage] sending message to peer", msg)
-	} else {
-		var bufBytes bytes.Buffer
-		if err := gob.NewEncoder(&bufBytes).Encode(msg); err != nil {
-			return err
-		}
+// end of conn is receives the message. The message is encoded with wire if possible,
+// and fragmented if it is too big for one datagram.
+func SendMessage(conn *net.UDPConn, addr *net.UDPAddr, msg interface{}, wire WireVersion, logger *govec.GoLog, logUpdates bool) error {
+	buf, err := encodeMessage(msg, wire, logger, logUpdates)
+	if err != nil {
+		return err
+	}
 
-		buf = bufBytes.Bytes()
+	datagrams, err := fragment(buf)
+	if err != nil {
+		return err
 	}
 
-	var err error
-	if addr == nil {
-		_, err = conn.Write(buf)
-	} else {
-		_, err = conn.WriteTo(buf, addr)
+	for _, datagram := range datagrams {
+		if addr == nil {
+			_, err = conn.Write(datagram)
+		} else {
+			_, err = conn.WriteTo(datagram, addr)
+		}
+
+		if err != nil {
+			return err
+		}
 	}
 
-	return err
+	return nil
 }
 
-func ReceiveMessage(conn *net.UDPConn, msg interface{}, logger *govec.GoLog, logUpdates bool) (*net.UDPAddr, error) {
-	buf := make([]byte, 0x400)
+// Receives the next whole message on conn, putting fragments back together with
+// reassembler. Returns who sent it and how it was encoded, or an error if a message
+// was dropped because its fragments didn't all arrive in time. That is noticed
+// even if nothing else arrives, as reads time out when the oldest incomplete
+// message is due to expire.
+func ReceiveMessage(conn *net.UDPConn, reassembler *Reassembler, msg interface{}, logger *govec.GoLog, logUpdates bool) (*net.UDPAddr, WireVersion, error) {
+	// Leave room to notice datagrams that are bigger than they should be
+	buf := make([]byte, MAX_DATAGRAM_SIZE+1)
 
-	n, addr, err := conn.ReadFromUDP(buf)
-	if err != nil {
-		return nil, err
-	}
+	for {
+		if err := reassembler.Expire(Clock.Now()); err != nil {
+			return nil, WIRE_GOB, err
+		}
 
-	if logUpdates {
-		logger.UnpackReceive("[ReceiveMessage] received message from peer", buf[:n], msg)
-	} else {
-		if err := gob.NewDecoder(bytes.NewReader(buf[:n])).Decode(msg); err != nil {
-			return nil, err
+		var deadline time.Time
+		if wait, ok := reassembler.NextExpiry(Clock.Now()); ok {
+			deadline = time.Now().Add(wait)
+		}
+		conn.SetReadDeadline(deadline)
+
+		n, addr, err := conn.ReadFromUDP(buf)
+		if e, ok := err.(net.Error); ok && e.Timeout() && !deadline.IsZero() {
+			// Time to expire whatever is still incomplete
+			continue
+		}
+		if err != nil {
+			return nil, WIRE_GOB, err
+		}
+
+		if n > MAX_DATAGRAM_SIZE {
+			return addr, WIRE_GOB, MalformedFragmentError("datagram larger than maximum size")
 		}
-	}
 
-	return addr, nil
+		whole, err := reassembler.Add(addr, buf[:n], Clock.Now())
+		if err != nil {
+			return addr, WIRE_GOB, err
+		}
+
+		if whole == nil {
+			// Still waiting on the rest of this message
+			continue
+		}
+
+		wire, err := decodeMessage(whole, msg, logger, logUpdates)
+		if err != nil {
+			return nil, wire, err
+		}
+
+		return addr, wire, nil
+	}
 }
@@ -10,6 +10,20 @@ const (
 	POSITION UpdateKind = iota
 	FIRE
 	DEAD
+	// A claim that a bullet hit a player. Kills need claims from the shooter
+	// and a witness before they count.
+	HIT
+	// Tells a player its position was rejected, and where it was last accepted
+	CORRECTION
+	// A confirmed hit. Every client works these out for itself from HIT
+	// claims, so they are never sent.
+	DAMAGE
+	// A dead player coming back at a spawn point
+	RESPAWN
+	// Proposes a match, counting down from the update's time
+	START
+	// Claims a pickup. The first claim on each one gets it.
+	PICKUP
 )
 
 const (
@@ -25,7 +39,36 @@ type Update struct {
 	PlayerID    uint64
 	OtherPlayer uint64
 	Pos         pixel.Vec
-	Angle       float64
+	// Velocity of the player at Pos, in units per second
+	Vel   pixel.Vec
+	Angle float64
+	// How many peers this update has passed through to get here
+	Hops int
+	// Nonce of the update this one is about, such as the shot a HIT claims,
+	// or the number of the pickup a PICKUP claims
+	Ref uint64
+	// Sequence number of the last local input applied, on POSITION updates,
+	// or of the shot, on FIRE updates
+	Seq uint64
+	// How much health a DAMAGE update takes away
+	Damage int
+	// Which weapon a FIRE update fired, see worldlib.Weapons
+	Weapon int
+}
+
+// Whether this update has to make it to everyone. Position updates are sent often
+// enough that a lost one is replaced by the next.
+func (u Update) IsReliable() bool {
+	return u.Kind != POSITION
+}
+
+// Whether this update comes before another in the order every client agrees on:
+// by timestamp, with the nonce breaking ties
+func (u Update) Before(other Update) bool {
+	if !u.Time.Equal(other.Time) {
+		return u.Time.Before(other.Time)
+	}
+	return u.Nonce < other.Nonce
 }
 
 func DeadPlayer(playerID uint64, cause uint64) Update {
@@ -36,12 +79,70 @@ func DeadPlayer(playerID uint64, cause uint64) Update {
 	}
 }
 
-func FireBullet(playerID uint64, pos pixel.Vec, angle float64) Update {
+func HitClaim(claimant uint64, victim uint64, shot uint64, pos pixel.Vec) Update {
+	return Update{
+		Kind:        HIT,
+		PlayerID:    claimant,
+		OtherPlayer: victim,
+		Pos:         pos,
+		Ref:         shot,
+	}
+}
+
+// A correction from validator to a player whose position it rejected. It says
+// where the player was at the last input the validator accepted.
+func Correction(validator uint64, player uint64, seq uint64, pos pixel.Vec, rejected uint64) Update {
+	return Update{
+		Kind:        CORRECTION,
+		PlayerID:    validator,
+		OtherPlayer: player,
+		Pos:         pos,
+		Seq:         seq,
+		Ref:         rejected,
+	}
+}
+
+func DamagePlayer(victim uint64, shooter uint64, shot uint64, damage int) Update {
+	return Update{
+		Kind:        DAMAGE,
+		PlayerID:    victim,
+		OtherPlayer: shooter,
+		Ref:         shot,
+		Damage:      damage,
+	}
+}
+
+func Respawn(playerID uint64, pos pixel.Vec) Update {
+	return Update{
+		Kind:     RESPAWN,
+		PlayerID: playerID,
+		Pos:      pos,
+	}
+}
+
+func StartMatch(playerID uint64) Update {
+	return Update{
+		Kind:     START,
+		PlayerID: playerID,
+	}
+}
+
+func CollectPickup(playerID uint64, pickup uint64, pos pixel.Vec) Update {
+	return Update{
+		Kind:     PICKUP,
+		PlayerID: playerID,
+		Pos:      pos,
+		Ref:      pickup,
+	}
+}
+
+func FireBullet(playerID uint64, pos pixel.Vec, angle float64, weapon int) Update {
 	return Update{
 		Kind:     FIRE,
 		PlayerID: playerID,
 		Pos:      pos,
 		Angle:    angle,
+		Weapon:   weapon,
 	}
 }
 
@@ -1,26 +1,143 @@
 package clocklib
 
 import (
-	"sync/atomic"
+	"sync"
 	"time"
 )
 
+const (
+	// How fast the offset may change while slewing, in seconds per second. Less
+	// than one, so that slewing never makes time go backwards.
+	MaxSlewRate = 0.05
+	// Adjustments bigger than this are stepped instead of slewed
+	StepThreshold = 500 * time.Millisecond
+)
+
+// A Clock that also tells synchronized time, through GetCurrentTime. Now,
+// Since, sleeps and timers go by the underlying clock, unaffected by the
+// offset, so durations measured with them never jump when it is stepped.
 type ClockManagerAPI interface {
+	Clock
 	GetCurrentTime() time.Time
+	GetOffset() time.Duration
+	SetOffset(offset time.Duration)
+	AdjustOffset(delta time.Duration)
 }
 
+// Keeps the local clock's offset from the synchronized time. Small adjustments
+// are slewed in gradually, so time never jumps. The zero value runs off the
+// system clock.
 type ClockManager struct {
-	offset int64
+	lock sync.Mutex
+	base Clock
+	// Offset when we started slewing
+	offset time.Duration
+	// Offset we are slewing towards
+	target    time.Duration
+	slewStart time.Time
+}
+
+func NewClockManager(base Clock) *ClockManager {
+	return &ClockManager{base: base}
+}
+
+func (m *ClockManager) clock() Clock {
+	if m.base == nil {
+		return RealClock{}
+	}
+	return m.base
+}
+
+// NOTE: must hold the lock before calling
+func (m *ClockManager) currentOffset(now time.Time) time.Duration {
+	remaining := m.target - m.offset
+	if remaining == 0 {
+		return m.offset
+	}
+
+	maxChange := time.Duration(float64(now.Sub(m.slewStart)) * MaxSlewRate)
+
+	if remaining > 0 {
+		if remaining <= maxChange {
+			return m.target
+		}
+		return m.offset + maxChange
+	}
+
+	if -remaining <= maxChange {
+		return m.target
+	}
+	return m.offset - maxChange
 }
 
+// Steps the offset straight to a new value
 func (m *ClockManager) SetOffset(offset time.Duration) {
-	atomic.StoreInt64(&m.offset, int64(offset))
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.offset = offset
+	m.target = offset
+	m.slewStart = m.clock().Now()
+}
+
+// Moves the offset by delta, gradually unless delta is very large
+func (m *ClockManager) AdjustOffset(delta time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := m.clock().Now()
+	current := m.currentOffset(now)
+
+	m.target = current + delta
+	if delta > StepThreshold || delta < -StepThreshold {
+		m.offset = m.target
+	} else {
+		m.offset = current
+	}
+	m.slewStart = now
 }
 
 func (m *ClockManager) GetOffset() time.Duration {
-	return time.Duration(atomic.LoadInt64(&m.offset))
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.currentOffset(m.clock().Now())
 }
 
 func (m *ClockManager) GetCurrentTime() time.Time {
-	return time.Now().Add(m.GetOffset())
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := m.clock().Now()
+	return now.Add(m.currentOffset(now))
+}
+
+// -----------------------------------------------------------------------------
+
+// Clock interface
+
+// The underlying clock's time, without the offset. Use GetCurrentTime for the
+// time everyone agrees on.
+func (m *ClockManager) Now() time.Time {
+	return m.clock().Now()
+}
+
+func (m *ClockManager) Since(t time.Time) time.Duration {
+	return m.clock().Since(t)
+}
+
+func (m *ClockManager) Sleep(d time.Duration) {
+	m.clock().Sleep(d)
+}
+
+func (m *ClockManager) After(d time.Duration) <-chan time.Time {
+	return m.clock().After(d)
+}
+
+func (m *ClockManager) NewTimer(d time.Duration) Timer {
+	return m.clock().NewTimer(d)
+}
+
+func (m *ClockManager) NewTicker(d time.Duration) Ticker {
+	return m.clock().NewTicker(d)
 }
@@ -0,0 +1,97 @@
+package clocklib
+
+import (
+	"testing"
+	"time"
+)
+
+var start = time.Unix(1000, 0)
+
+func TestOffsetOnlyMovesCurrentTime(t *testing.T) {
+	fake := NewFakeClock(start)
+	m := NewClockManager(fake)
+
+	m.SetOffset(time.Hour)
+	if !m.Now().Equal(start) {
+		t.Errorf("Now moved with the offset, to %v", m.Now())
+	}
+	if got := m.GetCurrentTime(); !got.Equal(start.Add(time.Hour)) {
+		t.Errorf("Expected synchronized time %v, got %v", start.Add(time.Hour), got)
+	}
+
+	last := m.Now()
+	fake.Advance(time.Second)
+	m.SetOffset(-time.Hour)
+	if d := m.Since(last); d != time.Second {
+		t.Errorf("Expected a second to pass across a step, got %v", d)
+	}
+}
+
+func TestSmallAdjustmentsSlew(t *testing.T) {
+	fake := NewFakeClock(start)
+	m := NewClockManager(fake)
+
+	m.AdjustOffset(100 * time.Millisecond)
+	if offset := m.GetOffset(); offset != 0 {
+		t.Errorf("Offset jumped to %v", offset)
+	}
+
+	fake.Advance(time.Second)
+	if offset, want := m.GetOffset(), time.Duration(float64(time.Second)*MaxSlewRate); offset != want {
+		t.Errorf("Expected offset %v after a second, got %v", want, offset)
+	}
+
+	fake.Advance(time.Minute)
+	if offset := m.GetOffset(); offset != 100*time.Millisecond {
+		t.Errorf("Expected offset to settle at 100ms, got %v", offset)
+	}
+}
+
+func TestLargeAdjustmentsStep(t *testing.T) {
+	m := NewClockManager(NewFakeClock(start))
+
+	m.AdjustOffset(2 * StepThreshold)
+	if offset := m.GetOffset(); offset != 2*StepThreshold {
+		t.Errorf("Expected offset to step to %v, got %v", 2*StepThreshold, offset)
+	}
+}
+
+func TestFakeClockFiresInOrder(t *testing.T) {
+	fake := NewFakeClock(start)
+
+	late := fake.NewTimer(2 * time.Second)
+	early := fake.After(time.Second)
+	ticker := fake.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	fake.Advance(1500 * time.Millisecond)
+
+	select {
+	case at := <-early:
+		if !at.Equal(start.Add(time.Second)) {
+			t.Errorf("Timer fired at %v", at)
+		}
+	default:
+		t.Errorf("Timer due after a second didn't fire")
+	}
+	select {
+	case <-late.C():
+		t.Errorf("Timer fired early")
+	default:
+	}
+	select {
+	case <-ticker.C():
+	default:
+		t.Errorf("Ticker didn't tick")
+	}
+
+	if !late.Stop() {
+		t.Errorf("Couldn't stop a pending timer")
+	}
+	fake.Advance(time.Second)
+	select {
+	case <-late.C():
+		t.Errorf("Stopped timer fired")
+	default:
+	}
+}
@@ -0,0 +1,174 @@
+package clocklib
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// A clock that only moves when told to. Sleepers, timers and tickers fire as
+// Advance carries the time past their deadlines, in deadline order.
+type FakeClock struct {
+	lock sync.Mutex
+	// Signalled whenever someone starts waiting on the clock
+	waiting *sync.Cond
+	now     time.Time
+	timers  []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock    *FakeClock
+	c        chan time.Time
+	deadline time.Time
+	// Zero for one-shot timers
+	period time.Duration
+}
+
+func NewFakeClock(start time.Time) *FakeClock {
+	c := &FakeClock{now: start}
+	c.waiting = sync.NewCond(&c.lock)
+	return c
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+func (c *FakeClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *FakeClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	return c.addTimer(d, 0)
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clocklib: non-positive interval for NewTicker")
+	}
+	return fakeTicker{c.addTimer(d, d)}
+}
+
+func (c *FakeClock) addTimer(d time.Duration, period time.Duration) *fakeTimer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	t := &fakeTimer{
+		clock:    c,
+		c:        make(chan time.Time, 1),
+		deadline: c.now.Add(d),
+		period:   period,
+	}
+
+	if d <= 0 && period == 0 {
+		// Already due
+		t.c <- c.now
+		return t
+	}
+
+	c.timers = append(c.timers, t)
+	c.waiting.Broadcast()
+	return t
+}
+
+// NOTE: must acquire lock before calling
+func (c *FakeClock) removeTimer(t *fakeTimer) bool {
+	for i, other := range c.timers {
+		if other == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Moves the clock forward by d, firing everything that comes due on the way
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	end := c.now.Add(d)
+
+	for {
+		sort.Slice(c.timers, func(i, j int) bool {
+			return c.timers[i].deadline.Before(c.timers[j].deadline)
+		})
+
+		if len(c.timers) == 0 || c.timers[0].deadline.After(end) {
+			break
+		}
+
+		t := c.timers[0]
+		c.now = t.deadline
+
+		// Like real tickers, drop ticks nobody is keeping up with
+		select {
+		case t.c <- c.now:
+		default:
+		}
+
+		if t.period > 0 {
+			t.deadline = t.deadline.Add(t.period)
+		} else {
+			c.timers = c.timers[1:]
+		}
+	}
+
+	c.now = end
+}
+
+// Blocks until at least n sleepers, timers or tickers are waiting on the clock.
+// Lets a test be sure a worker has gone to sleep before advancing past it.
+func (c *FakeClock) BlockUntil(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for len(c.timers) < n {
+		c.waiting.Wait()
+	}
+}
+
+type fakeTicker struct {
+	t *fakeTimer
+}
+
+func (t fakeTicker) C() <-chan time.Time {
+	return t.t.c
+}
+
+func (t fakeTicker) Stop() {
+	t.t.Stop()
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+
+	return t.clock.removeTimer(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+
+	active := t.clock.removeTimer(t)
+	t.deadline = t.clock.now.Add(d)
+	t.clock.timers = append(t.clock.timers, t)
+	t.clock.waiting.Broadcast()
+	return active
+}
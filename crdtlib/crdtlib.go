@@ -36,6 +36,7 @@ import (
 type ValueType struct {
 	NumKills  int
 	NumDeaths int
+	NumWins   int
 }
 
 // A GetArg represents an argument type passed when a client the server an RPC
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"../clientlib"
+	"../serverlib"
+	"log"
+	"time"
+)
+
+// Clock discipline, NTP style. Every client in a room is sampled several times
+// (see clientlib.SampleClock), and then told how far to adjust, Berkeley style.
+// Clients slew their clocks towards it. This repeats periodically so clocks that
+// drift get pulled back in.
+
+const (
+	CLOCK_SYNC_INTERVAL = 15 * time.Second
+	// Clients drop updates older than this (TimeDelta in the client's
+	// RecordWorker), so a client this far off is effectively not playing
+	MAX_CLOCK_SKEW = time.Second
+	// Weight given to the newest drift estimate
+	CLOCK_DRIFT_SMOOTHING = 0.5
+)
+
+// Syncs the clocks of every client playing in a room
+func syncClocks(roomName string) {
+	rooms.RLock()
+	room, ok := rooms.m[roomName]
+	rooms.RUnlock()
+
+	if !ok {
+		return
+	}
+
+	room.syncLock.Lock()
+	defer room.syncLock.Unlock()
+
+	Logger.LogLocalEvent("Syncing Clocks in room " + roomName)
+
+	// Work out who to sync without holding the lock over the network
+	clients := make(map[uint64]*clientlib.ClientClockRemote)
+
+	connections.Lock()
+	for key, connection := range connections.m {
+		if connection.status != CONNECTED || connection.room != roomName {
+			continue
+		}
+
+		if connection.rpcClient == nil {
+			log.Println("syncClocks() Client", key, "not connected yet")
+			continue
+		}
+
+		if connection.client == nil {
+			connection.client = clientlib.NewClientClockRemoteAPI(connection.rpcClient)
+		}
+		clients[key] = connection.client
+	}
+	connections.Unlock()
+
+	if len(clients) == 0 {
+		return
+	}
+
+	roomTime := room.Time
+
+	// The room's own clock counts as a sample with no offset
+	m := make(map[uint64]clientlib.ClockSample)
+	var offsetTotal time.Duration
+	var offsetNum time.Duration = 1
+
+	for key, client := range clients {
+		sample, err := clientlib.SampleClock(client, roomTime, Logger)
+		if err != nil {
+			log.Println("syncClocks() Skipping unresponsive client", key)
+			continue
+		}
+
+		m[key] = sample
+		offsetTotal += sample.Offset
+		offsetNum++
+	}
+
+	offsetAverage := offsetTotal / offsetNum
+
+	now := roomTime()
+
+	for key, sample := range m {
+		adjustment := offsetAverage - sample.Offset
+
+		connections.Lock()
+		if connection, ok := connections.m[key]; ok {
+			connection.offset = adjustment
+			connection.clockStats = updateClockStats(key, roomName, connection.clockStats, sample, -adjustment, now)
+		}
+		connections.Unlock()
+
+		if err := clients[key].AdjustOffset(adjustment, Logger); err != nil {
+			log.Println("syncClocks() Error adjusting clock of client", key, ":", err)
+		}
+	}
+
+	Logger.LogLocalEvent("Setting room clock offset")
+	room.offsetLock.Lock()
+	room.offset += offsetAverage
+	room.offsetLock.Unlock()
+}
+
+// The room's shared time
+func (room *Room) Time() time.Time {
+	room.offsetLock.Lock()
+	defer room.offsetLock.Unlock()
+
+	return Clock.GetCurrentTime().Add(room.offset)
+}
+
+// Folds the latest sample into a client's stats. Every sync pulls the client
+// back onto the room's clock, so whatever skew it has built up since the last
+// one is drift.
+func updateClockStats(clientID uint64, roomName string, stats serverlib.ClockStats, sample clientlib.ClockSample, skew time.Duration, now time.Time) serverlib.ClockStats {
+	if !stats.LastSync.IsZero() && stats.Room == roomName {
+		elapsed := now.Sub(stats.LastSync)
+		if elapsed > 0 {
+			drift := float64(skew) / float64(elapsed) * 1e6
+			if stats.DriftPPM == 0 {
+				stats.DriftPPM = drift
+			} else {
+				stats.DriftPPM += CLOCK_DRIFT_SMOOTHING * (drift - stats.DriftPPM)
+			}
+		}
+	} else {
+		// A new room means a new clock to drift from
+		stats.DriftPPM = 0
+	}
+
+	stats.ClientID = clientID
+	stats.Room = roomName
+	stats.RTT = sample.RTT
+	stats.ErrorBound = sample.RTT / 2
+	stats.Skew = skew
+	stats.LastSync = now
+
+	if skew > MAX_CLOCK_SKEW || skew < -MAX_CLOCK_SKEW {
+		log.Printf("WARNING: client %d clock is off by %v (error %v, drift %.1f ppm); "+
+			"its peers will drop its updates until it is pulled back in\n",
+			clientID, skew, stats.ErrorBound, stats.DriftPPM)
+	}
+
+	return stats
+}
+
+func clockSyncWorker() {
+	for {
+		Clock.Sleep(CLOCK_SYNC_INTERVAL)
+
+		rooms.RLock()
+		var names []string
+		for name := range rooms.m {
+			names = append(names, name)
+		}
+		rooms.RUnlock()
+
+		for _, name := range names {
+			syncClocks(name)
+		}
+	}
+}
+
+func (s *TankServer) GetClockStats(request serverlib.RoomRequest, response *serverlib.ClockStatsResponse) error {
+	log.Println("GetClockStats()", request.ClientID, request.Room)
+	var room string
+	Logger.UnpackReceive("[GetClockStats] received from client", request.B, &room)
+
+	connections.RLock()
+	defer connections.RUnlock()
+
+	room = request.Room
+	if room == "" {
+		room = roomOf(request.ClientID)
+	}
+
+	var stats []serverlib.ClockStats
+	for _, connection := range connections.m {
+		if connection.status == CONNECTED && connection.room == room && !connection.clockStats.LastSync.IsZero() {
+			stats = append(stats, connection.clockStats)
+		}
+	}
+
+	b := Logger.PrepareSend("[GetClockStats] Request accepted from client", stats)
+	*response = serverlib.ClockStatsResponse{stats, b}
+	return nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// The peer overlay for a room is kept as a random regular graph. New nodes join
+// by splitting random edges, which keeps every degree at OverlayDegree and the
+// graph an expander with high probability. When a node leaves, its neighbours
+// are paired up with each other, and any split or under-connected nodes that
+// leaves behind are patched up.
+
+const (
+	// Should be even, since each join splits OverlayDegree/2 edges
+	OverlayDegree = 4
+	// Repairs may push a node a little past OverlayDegree
+	MaxOverlayDegree = OverlayDegree + 2
+)
+
+type Overlay struct {
+	adj map[uint64]map[uint64]bool
+}
+
+func NewOverlay() *Overlay {
+	return &Overlay{
+		adj: make(map[uint64]map[uint64]bool),
+	}
+}
+
+func (o *Overlay) Contains(id uint64) bool {
+	_, ok := o.adj[id]
+	return ok
+}
+
+func (o *Overlay) Neighbours(id uint64) []uint64 {
+	var nbrs []uint64
+	for nbr := range o.adj[id] {
+		nbrs = append(nbrs, nbr)
+	}
+
+	sort.Slice(nbrs, func(i, j int) bool { return nbrs[i] < nbrs[j] })
+	return nbrs
+}
+
+func (o *Overlay) Add(id uint64) {
+	if o.Contains(id) {
+		return
+	}
+
+	others := o.nodes()
+	o.adj[id] = make(map[uint64]bool)
+
+	if len(others) <= OverlayDegree {
+		// Small enough to just connect to everyone
+		for _, other := range others {
+			o.link(id, other)
+		}
+	} else {
+		// Split random edges (a, b) into (a, id) and (id, b)
+		edges := o.edges()
+		rand.Shuffle(len(edges), func(i, j int) { edges[i], edges[j] = edges[j], edges[i] })
+
+		for _, e := range edges {
+			if len(o.adj[id]) >= OverlayDegree {
+				break
+			}
+
+			if o.adj[id][e[0]] || o.adj[id][e[1]] || !o.adj[e[0]][e[1]] {
+				continue
+			}
+
+			o.unlink(e[0], e[1])
+			o.link(id, e[0])
+			o.link(id, e[1])
+		}
+	}
+
+	o.repair()
+}
+
+func (o *Overlay) Remove(id uint64) {
+	if !o.Contains(id) {
+		return
+	}
+
+	nbrs := o.Neighbours(id)
+	for _, nbr := range nbrs {
+		o.unlink(id, nbr)
+	}
+	delete(o.adj, id)
+
+	// Pair up the neighbours we left behind, so their degrees stay the same
+	rand.Shuffle(len(nbrs), func(i, j int) { nbrs[i], nbrs[j] = nbrs[j], nbrs[i] })
+	for i := 0; i+1 < len(nbrs); i += 2 {
+		if !o.adj[nbrs[i]][nbrs[i+1]] {
+			o.link(nbrs[i], nbrs[i+1])
+		}
+	}
+
+	o.repair()
+}
+
+// Adds an edge between two nodes in the overlay, to heal a partition the
+// nodes noticed themselves. Either end that goes past MaxOverlayDegree drops
+// another edge to make room.
+func (o *Overlay) Bridge(a, b uint64) {
+	if a == b || !o.Contains(a) || !o.Contains(b) || o.adj[a][b] {
+		return
+	}
+
+	o.link(a, b)
+	o.trim(a, b)
+	o.trim(b, a)
+}
+
+// Drops edges from id until it is back down to MaxOverlayDegree, best
+// connected neighbours first, keeping the edge to keep. Edges the overlay can't
+// do without are kept too, so it stays connected.
+func (o *Overlay) trim(id uint64, keep uint64) {
+	nbrs := o.Neighbours(id)
+	sort.SliceStable(nbrs, func(i, j int) bool { return len(o.adj[nbrs[i]]) > len(o.adj[nbrs[j]]) })
+
+	for _, nbr := range nbrs {
+		if len(o.adj[id]) <= MaxOverlayDegree {
+			return
+		}
+		if nbr == keep {
+			continue
+		}
+
+		o.unlink(id, nbr)
+		if len(o.components()) > 1 {
+			o.link(id, nbr)
+		}
+	}
+}
+
+func (o *Overlay) link(a, b uint64) {
+	o.adj[a][b] = true
+	o.adj[b][a] = true
+}
+
+func (o *Overlay) unlink(a, b uint64) {
+	delete(o.adj[a], b)
+	delete(o.adj[b], a)
+}
+
+func (o *Overlay) nodes() []uint64 {
+	var nodes []uint64
+	for id := range o.adj {
+		nodes = append(nodes, id)
+	}
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i] < nodes[j] })
+	return nodes
+}
+
+func (o *Overlay) edges() [][2]uint64 {
+	var edges [][2]uint64
+	for _, a := range o.nodes() {
+		for b := range o.adj[a] {
+			if a < b {
+				edges = append(edges, [2]uint64{a, b})
+			}
+		}
+	}
+
+	return edges
+}
+
+// Returns the connected components of the overlay, largest first
+func (o *Overlay) components() [][]uint64 {
+	seen := make(map[uint64]bool)
+	var comps [][]uint64
+
+	for _, start := range o.nodes() {
+		if seen[start] {
+			continue
+		}
+
+		comp := []uint64{start}
+		seen[start] = true
+		for i := 0; i < len(comp); i++ {
+			for nbr := range o.adj[comp[i]] {
+				if !seen[nbr] {
+					seen[nbr] = true
+					comp = append(comp, nbr)
+				}
+			}
+		}
+
+		comps = append(comps, comp)
+	}
+
+	sort.SliceStable(comps, func(i, j int) bool { return len(comps[i]) > len(comps[j]) })
+	return comps
+}
+
+// Returns the node in nodes with the fewest neighbours
+func (o *Overlay) leastConnected(nodes []uint64) uint64 {
+	best := nodes[0]
+	for _, id := range nodes[1:] {
+		if len(o.adj[id]) < len(o.adj[best]) {
+			best = id
+		}
+	}
+
+	return best
+}
+
+// Reconnects a split overlay, then tops up nodes below OverlayDegree
+func (o *Overlay) repair() {
+	for comps := o.components(); len(comps) > 1; comps = o.components() {
+		o.link(o.leastConnected(comps[0]), o.leastConnected(comps[1]))
+	}
+
+	nodes := o.nodes()
+	for _, a := range nodes {
+		for _, b := range nodes {
+			if len(o.adj[a]) >= OverlayDegree {
+				break
+			}
+
+			if a == b || o.adj[a][b] || len(o.adj[b]) >= OverlayDegree {
+				continue
+			}
+
+			o.link(a, b)
+		}
+	}
+}
@@ -3,7 +3,7 @@
 	This server is responsible for peer discovery and clock synchronization
 
 	Usage:
-		go run server.go <IP Address : Port>
+		go run *.go <IP Address : Port>
 */
 
 package main
@@ -37,7 +37,23 @@ type Connection struct {
 	rpcAddress  string
 	client      *clientlib.ClientClockRemote
 	offset      time.Duration
-	partner     serverlib.PeerInfo
+	room        string
+	clockStats  serverlib.ClockStats
+}
+
+// A room hosts a single independent match
+type Room struct {
+	name string
+	// When it was created, so rooms nobody joins can be closed
+	created time.Time
+	// Offset of this room's shared clock from the server's clock. Guarded by
+	// offsetLock, as clients read the room's time while a sync is changing it.
+	offset     time.Duration
+	offsetLock sync.Mutex
+	// Who talks to whom. Guarded by the connections lock.
+	overlay *Overlay
+	// Only one clock sync at a time per room
+	syncLock sync.Mutex
 }
 
 type Status int
@@ -65,6 +81,27 @@ func (e DisplayNameInUseError) Error() string {
 	return fmt.Sprintf("Display Name [%s] is already in use.", string(e))
 }
 
+// Contains bad room name
+type NoSuchRoomError string
+
+func (e NoSuchRoomError) Error() string {
+	return fmt.Sprintf("Room [%s] does not exist.", string(e))
+}
+
+// Contains room name
+type RoomExistsError string
+
+func (e RoomExistsError) Error() string {
+	return fmt.Sprintf("Room [%s] already exists.", string(e))
+}
+
+// Contains client ID
+type ClientInGameError string
+
+func (e ClientInGameError) Error() string {
+	return fmt.Sprintf("Client [%s] is in a game. Please disconnect first.", string(e))
+}
+
 // -----------------------------------------------------------------------------
 
 // KV: Key is not available on any online client.
@@ -79,7 +116,11 @@ func (e KeyUnavailableError) Error() string {
 // State Variables
 
 const (
-	MinPeerConnections = 2
+	MinPeerConnections = OverlayDegree
+	// Clients are placed here until they join another room
+	DefaultRoom = "lobby"
+	// How long a room may stay empty before it is closed
+	EmptyRoomTimeout = time.Minute
 )
 
 var connections = struct {
@@ -87,6 +128,11 @@ var connections = struct {
 	m map[uint64]*Connection
 }{m: make(map[uint64]*Connection)}
 
+var rooms = struct {
+	sync.RWMutex
+	m map[string]*Room
+}{m: map[string]*Room{DefaultRoom: {name: DefaultRoom, overlay: NewOverlay()}}}
+
 var displayNames = struct {
 	sync.RWMutex
 	M map[string]bool
@@ -98,7 +144,7 @@ var Logger *govec.GoLog
 
 var StatsLogger *govec.GoLog
 
-var Clock *clocklib.ClockManager = &clocklib.ClockManager{}
+var Clock clocklib.ClockManagerAPI = clocklib.NewClockManager(clocklib.RealClock{})
 
 // -----------------------------------------------------------------------------
 
@@ -141,9 +187,10 @@ func (s *TankServer) KVGet(request *serverlib.KVGetRequest, response *serverlib.
 	var reply crdtlib.GetReply
 	found := false
 	key := arg.Key
+	room := roomOf(arg.ClientId)
 	for _, clientId_ := range keyToClients.M[key] {
 		client, ok := connections.m[clientId_]
-		if ok && client.status == CONNECTED {
+		if ok && client.status == CONNECTED && client.room == room {
 			latestOnline = clientId_
 			found = true
 		}
@@ -209,11 +256,12 @@ func (s *TankServer) KVPut(request *serverlib.KVPutRequest, response *serverlib.
 	key := arg.Key
 	value := arg.Value
 	clientsTmp := keyToClients.M[key]
+	room := roomOf(request.ClientID)
 
 	var clients []uint64
 	for _, clientId := range clientsTmp {
 		connection := connections.m[clientId]
-		if connection.status != CONNECTED {
+		if connection.status != CONNECTED || connection.room != room {
 			continue
 		}
 		clients = append(clients, clientId)
@@ -226,7 +274,7 @@ func (s *TankServer) KVPut(request *serverlib.KVPutRequest, response *serverlib.
 		// clients to store this key-value pair on.
 		var candidates []uint64
 		for clientId, connection := range connections.m {
-			if connection.status != CONNECTED {
+			if connection.status != CONNECTED || connection.room != room {
 				continue
 			}
 			// Do not choose a client if it already exists in our list.
@@ -301,71 +349,26 @@ func encodeToString(v interface{}) (s string) {
 	return s
 }
 
-func (s *TankServer) syncClocks() {
-	Logger.LogLocalEvent("Syncing Clocks")
-
-	connections.Lock()
-
-	if len(connections.m) == 0 {
-		connections.Unlock()
-		return
-	}
-
-	m := make(map[uint64]time.Duration)
-	var offsetTotal time.Duration = Clock.GetOffset()
-	var offsetNum time.Duration = 1
-
-	for key, connection := range connections.m {
-		if connection.status != CONNECTED {
-			continue
-		}
-
-		if connection.rpcClient == nil {
-			// TODO : Better failure handling
-			// Probably wanna mark the client DISCONNECTED
-			log.Fatal("syncClocks() Client", key, "not connected")
-		}
-
-		before := Clock.GetCurrentTime()
-
-		clockClient := clientlib.NewClientClockRemoteAPI(connection.rpcClient)
-		connection.client = clockClient
-		connections.m[key] = connection
-
-		t, err := clockClient.TimeRequest(Logger)
-		if err != nil {
-			log.Fatal(err)
-		}
-		after := Clock.GetCurrentTime()
-
-		clientTime := t.Add(after.Sub(before) / 2)
-		clientOffset := clientTime.Sub(after)
-		m[key] = clientOffset
-		offsetTotal += clientOffset
-		offsetNum++
+// Returns the room a client is in. Must hold the connections lock.
+func roomOf(clientID uint64) string {
+	if connection, ok := connections.m[clientID]; ok {
+		return connection.room
 	}
 
-	offsetAverage := offsetTotal / offsetNum
-
-	for key, connection := range connections.m {
-		if connection.status != CONNECTED {
-			continue
-		}
+	return DefaultRoom
+}
 
-		offset := offsetAverage - m[key]
-		connection.offset = offset
-		connections.m[key] = connection
+// Returns the overlay of a room. Must hold the connections lock.
+func overlayOf(roomName string) *Overlay {
+	rooms.RLock()
+	defer rooms.RUnlock()
 
-		err := connection.client.SetOffset(offset, Logger)
-		if err != nil {
-			log.Fatal(err)
-		}
+	if room, ok := rooms.m[roomName]; ok {
+		return room.overlay
 	}
 
-	Logger.LogLocalEvent("Setting local clock offset")
-	Clock.SetOffset(Clock.GetOffset() + offsetAverage)
-
-	connections.Unlock()
+	// The room is gone, so nobody can be talking in it
+	return NewOverlay()
 }
 
 func (s *TankServer) Register(request serverlib.RegisterRequest, settings *serverlib.RegisterResponse) error {
@@ -412,6 +415,7 @@ func (s *TankServer) Register(request serverlib.RegisterRequest, settings *serve
 	connections.m[request.ClientID] = &Connection{
 		status:      NOTINGAME,
 		displayName: request.DisplayName,
+		room:        DefaultRoom,
 	}
 
 	connections.Unlock()
@@ -461,20 +465,6 @@ func (s *TankServer) Connect(clientReq serverlib.ConnectRequest, response *serve
 		return errors.New("client already connected")
 	}
 
-	// find a partner node
-	var partner serverlib.PeerInfo
-
-	for id, otherC := range connections.m {
-		if id != clientID && otherC.status == CONNECTED {
-			partner.Address = otherC.address
-			partner.RPCAddress = otherC.rpcAddress
-			partner.ClientID = id
-			partner.DisplayName = otherC.displayName
-
-			break
-		}
-	}
-
 	connections.m[peerInfo.ClientID] = &Connection{
 		status:      CONNECTED,
 		displayName: peerInfo.DisplayName,
@@ -482,9 +472,12 @@ func (s *TankServer) Connect(clientReq serverlib.ConnectRequest, response *serve
 		rpcAddress:  peerInfo.RPCAddress,
 		rpcClient:   c.rpcClient,
 		offset:      0,
-		partner:     partner,
+		room:        c.room,
 	}
 
+	// Fit the new client into the overlay
+	overlayOf(c.room).Add(clientID)
+
 	connections.Unlock()
 
 	b := Logger.PrepareSend("[Connect] Request accepted from client", MinPeerConnections)
@@ -496,7 +489,7 @@ func (s *TankServer) Connect(clientReq serverlib.ConnectRequest, response *serve
 	}
 
 	// Sync clock with the new client
-	go s.syncClocks()
+	go syncClocks(c.room)
 
 	return nil
 }
@@ -523,8 +516,10 @@ func (s *TankServer) Disconnect(request serverlib.ClientIDRequest, response *ser
 		}
 		return InvalidClientError(clientID)
 	}
-	c.status = NOTINGAME
-	connections.m[clientID] = c
+	// It has to register again to come back, so don't keep it around to
+	// hold its room open
+	overlayOf(c.room).Remove(clientID)
+	delete(connections.m, clientID)
 	connections.Unlock()
 	b := Logger.PrepareSend("[DisConnect] Request accepted from client", MinPeerConnections)
 	if UseDinv {
@@ -563,29 +558,24 @@ func (s *TankServer) GetNodes(clientReq serverlib.ClientIDRequest, addrSet *serv
 
 	var peerAddresses []serverlib.PeerInfo
 
-	// DISCONNECTED is the zero value, so we can use it to test for non-existent clients
-	if connections.m[connections.m[clientID].partner.ClientID] == nil ||
-		connections.m[connections.m[clientID].partner.ClientID].status == DISCONNECTED {
-		// try to find a partner now
-		for id, c := range connections.m {
-			if id != clientID && c.status == CONNECTED {
-				// found a partner
-				connections.m[clientID].partner = serverlib.PeerInfo{
-					Address: c.address,
-					RPCAddress: c.rpcAddress,
-					ClientID: id,
-					DisplayName: c.displayName,
-				}
+	self := connections.m[clientID]
+	overlay := overlayOf(self.room)
 
-				break
-			}
-		}
+	if self.status == CONNECTED || self.status == RECONNECTED {
+		// A client that came back needs to be fit back in
+		overlay.Add(clientID)
 	}
 
-	// If our partner is connected, then produce it as a peer
-	if connections.m[connections.m[clientID].partner.ClientID] != nil &&
-		connections.m[connections.m[clientID].partner.ClientID].status == CONNECTED {
-		peerAddresses = append(peerAddresses, connections.m[clientID].partner)
+	// Produce our connected overlay neighbours as peers
+	for _, id := range overlay.Neighbours(clientID) {
+		if c, ok := connections.m[id]; ok && c.status == CONNECTED {
+			peerAddresses = append(peerAddresses, serverlib.PeerInfo{
+				Address:     c.address,
+				RPCAddress:  c.rpcAddress,
+				ClientID:    id,
+				DisplayName: c.displayName,
+			})
+		}
 	}
 
 	connections.Unlock()
@@ -608,6 +598,211 @@ func (s *TankServer) GetNodes(clientReq serverlib.ClientIDRequest, addrSet *serv
 	return nil
 }
 
+func (s *TankServer) GetBridges(request serverlib.BridgeRequest, response *serverlib.GetNodesResponse) error {
+	clientID := request.ClientID
+	log.Println("GetBridges()", clientID, request.Unreachable)
+	var unreachable []uint64
+	Logger.UnpackReceive("[GetBridges] received from client", request.B, &unreachable)
+
+	connections.Lock()
+	defer connections.Unlock()
+
+	self, ok := connections.m[clientID]
+	if !ok {
+		b := Logger.PrepareSend("[GetBridges] rejected from client", clientID)
+		*response = serverlib.GetNodesResponse{nil, b, b}
+		return InvalidClientError(fmt.Sprint(clientID))
+	}
+
+	overlay := overlayOf(self.room)
+
+	// Connect the client straight to every unreachable player still in its game
+	var bridges []serverlib.PeerInfo
+	for _, id := range request.Unreachable {
+		c, ok := connections.m[id]
+		if !ok || id == clientID || c.status != CONNECTED || c.room != self.room {
+			continue
+		}
+
+		overlay.Bridge(clientID, id)
+		bridges = append(bridges, serverlib.PeerInfo{
+			Address:     c.address,
+			RPCAddress:  c.rpcAddress,
+			ClientID:    id,
+			DisplayName: c.displayName,
+		})
+	}
+
+	b := Logger.PrepareSend("[GetBridges] accepted from client", clientID)
+	*response = serverlib.GetNodesResponse{bridges, b, b}
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+// Rooms: Server side functions for hosting many independent matches.
+
+func (s *TankServer) CreateRoom(request serverlib.RoomRequest, response *serverlib.RoomResponse) error {
+	log.Println("CreateRoom()", request.Room)
+	var room string
+	Logger.UnpackReceive("[CreateRoom] received from client", request.B, &room)
+
+	rooms.Lock()
+	defer rooms.Unlock()
+
+	if _, ok := rooms.m[request.Room]; ok || request.Room == "" {
+		b := Logger.PrepareSend("[CreateRoom] Request rejected from client", false)
+		*response = serverlib.RoomResponse{false, b}
+		return RoomExistsError(request.Room)
+	}
+
+	rooms.m[request.Room] = &Room{name: request.Room, created: Clock.Now(), overlay: NewOverlay()}
+
+	b := Logger.PrepareSend("[CreateRoom] Request accepted from client", true)
+	*response = serverlib.RoomResponse{true, b}
+	return nil
+}
+
+func (s *TankServer) ListRooms(request serverlib.RoomRequest, response *serverlib.ListRoomsResponse) error {
+	log.Println("ListRooms()", request.ClientID)
+	var clientID uint64
+	Logger.UnpackReceive("[ListRooms] received from client", request.B, &clientID)
+
+	connections.RLock()
+	rooms.RLock()
+
+	counts := make(map[string]int)
+	for _, connection := range connections.m {
+		if connection.status == CONNECTED {
+			counts[connection.room]++
+		}
+	}
+
+	var infos []serverlib.RoomInfo
+	for name := range rooms.m {
+		infos = append(infos, serverlib.RoomInfo{
+			Name:       name,
+			NumPlayers: counts[name],
+		})
+	}
+
+	rooms.RUnlock()
+	connections.RUnlock()
+
+	b := Logger.PrepareSend("[ListRooms] Request accepted from client", infos)
+	*response = serverlib.ListRoomsResponse{infos, b}
+	return nil
+}
+
+func (s *TankServer) JoinRoom(request serverlib.RoomRequest, response *serverlib.RoomResponse) error {
+	log.Println("JoinRoom()", request.ClientID, request.Room)
+	var room string
+	Logger.UnpackReceive("[JoinRoom] received from client", request.B, &room)
+
+	connections.Lock()
+	defer connections.Unlock()
+
+	if err := moveToRoom(request.ClientID, request.Room); err != nil {
+		b := Logger.PrepareSend("[JoinRoom] Request rejected from client", false)
+		*response = serverlib.RoomResponse{false, b}
+		return err
+	}
+
+	b := Logger.PrepareSend("[JoinRoom] Request accepted from client", true)
+	*response = serverlib.RoomResponse{true, b}
+	return nil
+}
+
+func (s *TankServer) LeaveRoom(request serverlib.RoomRequest, response *serverlib.RoomResponse) error {
+	log.Println("LeaveRoom()", request.ClientID)
+	var clientID uint64
+	Logger.UnpackReceive("[LeaveRoom] received from client", request.B, &clientID)
+
+	connections.Lock()
+	defer connections.Unlock()
+
+	if err := moveToRoom(request.ClientID, DefaultRoom); err != nil {
+		b := Logger.PrepareSend("[LeaveRoom] Request rejected from client", false)
+		*response = serverlib.RoomResponse{false, b}
+		return err
+	}
+
+	b := Logger.PrepareSend("[LeaveRoom] Request accepted from client", true)
+	*response = serverlib.RoomResponse{true, b}
+	return nil
+}
+
+// Moves a client that isn't in a game to another room, and cleans up the room
+// it left if nobody is left in it. Must hold the connections lock.
+func moveToRoom(clientID uint64, roomName string) error {
+	c, ok := connections.m[clientID]
+	if !ok {
+		return InvalidClientError(fmt.Sprint(clientID))
+	}
+
+	if c.status == CONNECTED || c.status == RECONNECTED {
+		return ClientInGameError(fmt.Sprint(clientID))
+	}
+
+	rooms.Lock()
+	defer rooms.Unlock()
+
+	if _, ok := rooms.m[roomName]; !ok {
+		return NoSuchRoomError(roomName)
+	}
+
+	old := c.room
+	c.room = roomName
+
+	if old != roomName && isEmpty(old) {
+		closeRoom(old)
+	}
+
+	return nil
+}
+
+// Whether nobody is in a room, not counting clients we have lost touch with.
+// Must hold the connections lock.
+func isEmpty(roomName string) bool {
+	for _, connection := range connections.m {
+		if connection.room == roomName && connection.status != DISCONNECTED {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Closes a room, unless it's the default one. Must hold the connections and
+// rooms locks.
+func closeRoom(roomName string) {
+	if roomName == DefaultRoom {
+		return
+	}
+
+	log.Println("Closing empty room", roomName)
+	delete(rooms.m, roomName)
+}
+
+// Closes rooms that have been empty for a while, such as ones nobody joined
+func roomWorker() {
+	for {
+		Clock.Sleep(EmptyRoomTimeout)
+
+		connections.Lock()
+		rooms.Lock()
+		for name, room := range rooms.m {
+			if isEmpty(name) && Clock.Since(room.created) >= EmptyRoomTimeout {
+				closeRoom(name)
+			}
+		}
+		rooms.Unlock()
+		connections.Unlock()
+	}
+}
+
+// -----------------------------------------------------------------------------
+
 func (s *TankServer) NotifyFailure(clientID uint64, ack *bool) error {
 	log.Println("NotifyFailure()", clientID)
 	connections.Lock()
@@ -616,6 +811,9 @@ func (s *TankServer) NotifyFailure(clientID uint64, ack *bool) error {
 	if conn, ok := connections.m[clientID]; ok && conn.status == CONNECTED {
 		conn.status = DISCONNECTED
 		connections.m[clientID] = conn
+
+		// Rebalance the overlay around the hole it left
+		overlayOf(conn.room).Remove(clientID)
 	}
 
 	*ack = true
@@ -624,10 +822,19 @@ func (s *TankServer) NotifyFailure(clientID uint64, ack *bool) error {
 
 func monitorConnections() {
 	for {
-		time.Sleep(time.Second * 2)
+		Clock.Sleep(time.Second * 2)
 		connections.Lock()
 		for id, connection := range connections.m {
 			if connection.status == DISCONNECTED {
+				// Nothing to come back to once its room has closed
+				rooms.RLock()
+				_, ok := rooms.m[connection.room]
+				rooms.RUnlock()
+				if !ok {
+					delete(connections.m, id)
+					continue
+				}
+
 				if success, _ := connection.client.Recover(); success {
 					connection.status = RECONNECTED
 					connections.m[id] = connection
@@ -682,7 +889,7 @@ func main() {
 	rand.Seed(time.Now().UnixNano())
 
 	if len(os.Args) != 2 {
-		log.Fatal("Usage: go run server.go <IP Address : Port>")
+		log.Fatal("Usage: go run *.go <IP Address : Port>")
 	}
 	ipAddr := os.Args[1]
 
@@ -713,6 +920,8 @@ func main() {
 	}
 
 	go monitorConnections()
+	go clockSyncWorker()
+	go roomWorker()
 
 	Logger = govec.InitGoVector("server", "serverlogfile")
 	StatsLogger = govec.InitGoVector("server", "serverstatslogfile")
@@ -14,12 +14,27 @@ type ServerAPI interface {
 
 	// KV: Key-value store API calls.
 	KVGet(key uint64, clientId uint64, logger *govec.GoLog) (crdtlib.GetReply, error)
-	KVPut(key uint64, value crdtlib.ValueType, logger *govec.GoLog) error
+	KVPut(key uint64, value crdtlib.ValueType, clientId uint64, logger *govec.GoLog) error
+
+	// -----------------------------------------------------------------------------
+
+	// Rooms: each room is an independent match.
+	CreateRoom(clientID uint64, room string, logger *govec.GoLog) error
+	ListRooms(clientID uint64, logger *govec.GoLog) ([]RoomInfo, error)
+	JoinRoom(clientID uint64, room string, logger *govec.GoLog) error
+	LeaveRoom(clientID uint64, logger *govec.GoLog) error
+
+	// -----------------------------------------------------------------------------
+
+	// Clocks: how well each client in a room is synchronized. An empty room
+	// means the caller's own.
+	GetClockStats(clientID uint64, room string, logger *govec.GoLog) ([]ClockStats, error)
 
 	// -----------------------------------------------------------------------------
 	Connect(address string, rpcAddress string, clientID uint64, displayName string, logger *govec.GoLog, useDinv bool) (int, error)
 	Register(displayName string, clientID uint64, logger *govec.GoLog, useDinv bool) (clientlib.PeerNetSettings, error)
 	GetNodes(clientID uint64, logger *govec.GoLog, useDinv bool) ([]PeerInfo, error)
+	GetBridges(clientID uint64, unreachable []uint64, logger *govec.GoLog) ([]PeerInfo, error)
 	Disconnect(clientID uint64, logger *govec.GoLog, useDinv bool) (bool, error)
 	NotifyFailure(clientID uint64) error
 }
@@ -54,6 +69,12 @@ type ClientIDRequest struct {
 	DinvB    []byte
 }
 
+type BridgeRequest struct {
+	ClientID    uint64
+	Unreachable []uint64
+	B           []byte
+}
+
 type RegisterResponse struct {
 	Settings clientlib.PeerNetSettings
 	B        []byte
@@ -89,8 +110,9 @@ type KVGetResponse struct {
 }
 
 type KVPutRequest struct {
-	Arg crdtlib.PutArg
-	B   []byte
+	Arg      crdtlib.PutArg
+	ClientID uint64
+	B        []byte
 }
 
 type KVPutResponse struct {
@@ -98,6 +120,47 @@ type KVPutResponse struct {
 	B     []byte
 }
 
+type RoomInfo struct {
+	Name       string
+	NumPlayers int
+}
+
+type RoomRequest struct {
+	ClientID uint64
+	Room     string
+	B        []byte
+}
+
+type RoomResponse struct {
+	Ack bool
+	B   []byte
+}
+
+type ListRoomsResponse struct {
+	Rooms []RoomInfo
+	B     []byte
+}
+
+// How well a client's clock was synchronized at its last sync
+type ClockStats struct {
+	ClientID uint64
+	Room     string
+	// Round trip time of the best sample
+	RTT time.Duration
+	// The client's true offset is within this of the measured one
+	ErrorBound time.Duration
+	// How far ahead of the room's clock the client's was before it was adjusted
+	Skew time.Duration
+	// How fast the client's clock wanders from the room's, in parts per million
+	DriftPPM float64
+	LastSync time.Time
+}
+
+type ClockStatsResponse struct {
+	Stats []ClockStats
+	B     []byte
+}
+
 // Error definitions
 
 type DisconnectedError string
@@ -133,19 +196,19 @@ func (r *RPCServerAPI) KVGet(key uint64, clientId uint64, logger *govec.GoLog) (
 	request := KVGetRequest{arg, b}
 	if err := r.doApiCall("TankServer.KVGet", &request, &response); err != nil {
 		logger.UnpackReceive("[KVGet] Get request to server errored out", response.B, &reply)
-		return crdtlib.GetReply{false, false, false, crdtlib.ValueType{0, 0}}, err
+		return crdtlib.GetReply{false, false, false, crdtlib.ValueType{0, 0, 0}}, err
 	}
 
 	logger.UnpackReceive("[KVGet] Get request to server succesful", response.B, &reply)
 	return response.Reply, nil
 }
 
-func (r *RPCServerAPI) KVPut(key uint64, value crdtlib.ValueType, logger *govec.GoLog) error {
+func (r *RPCServerAPI) KVPut(key uint64, value crdtlib.ValueType, clientId uint64, logger *govec.GoLog) error {
 	arg := crdtlib.PutArg{key, value}
 	var reply crdtlib.PutReply
 	var response KVPutResponse
 	b := logger.PrepareSend("[KVPut] Sending request to server", key)
-	request := KVPutRequest{arg, b}
+	request := KVPutRequest{arg, clientId, b}
 	if err := r.doApiCall("TankServer.KVPut", &request, &response); err != nil {
 		logger.UnpackReceive("[KVPut] Put request to server errored out", response.B, &reply)
 		return err
@@ -157,6 +220,80 @@ func (r *RPCServerAPI) KVPut(key uint64, value crdtlib.ValueType, logger *govec.
 
 // -----------------------------------------------------------------------------
 
+// Rooms: room API call implementations.
+
+func (r *RPCServerAPI) CreateRoom(clientID uint64, room string, logger *govec.GoLog) error {
+	var response RoomResponse
+	var ack bool
+	b := logger.PrepareSend("[CreateRoom] request sent to server", room)
+	request := RoomRequest{clientID, room, b}
+	if err := r.doApiCall("TankServer.CreateRoom", &request, &response); err != nil {
+		logger.UnpackReceive("[CreateRoom] request rejected by server", response.B, &ack)
+		return err
+	}
+
+	logger.UnpackReceive("[CreateRoom] request accepted by server", response.B, &ack)
+	return nil
+}
+
+func (r *RPCServerAPI) ListRooms(clientID uint64, logger *govec.GoLog) ([]RoomInfo, error) {
+	var response ListRoomsResponse
+	var rooms []RoomInfo
+	b := logger.PrepareSend("[ListRooms] request sent to server", clientID)
+	request := RoomRequest{clientID, "", b}
+	if err := r.doApiCall("TankServer.ListRooms", &request, &response); err != nil {
+		logger.UnpackReceive("[ListRooms] request rejected by server", response.B, &rooms)
+		return nil, err
+	}
+
+	logger.UnpackReceive("[ListRooms] request accepted by server", response.B, &rooms)
+	return response.Rooms, nil
+}
+
+func (r *RPCServerAPI) GetClockStats(clientID uint64, room string, logger *govec.GoLog) ([]ClockStats, error) {
+	var response ClockStatsResponse
+	var stats []ClockStats
+	b := logger.PrepareSend("[GetClockStats] request sent to server", room)
+	request := RoomRequest{clientID, room, b}
+	if err := r.doApiCall("TankServer.GetClockStats", &request, &response); err != nil {
+		logger.UnpackReceive("[GetClockStats] request rejected by server", response.B, &stats)
+		return nil, err
+	}
+
+	logger.UnpackReceive("[GetClockStats] request accepted by server", response.B, &stats)
+	return response.Stats, nil
+}
+
+func (r *RPCServerAPI) JoinRoom(clientID uint64, room string, logger *govec.GoLog) error {
+	var response RoomResponse
+	var ack bool
+	b := logger.PrepareSend("[JoinRoom] request sent to server", room)
+	request := RoomRequest{clientID, room, b}
+	if err := r.doApiCall("TankServer.JoinRoom", &request, &response); err != nil {
+		logger.UnpackReceive("[JoinRoom] request rejected by server", response.B, &ack)
+		return err
+	}
+
+	logger.UnpackReceive("[JoinRoom] request accepted by server", response.B, &ack)
+	return nil
+}
+
+func (r *RPCServerAPI) LeaveRoom(clientID uint64, logger *govec.GoLog) error {
+	var response RoomResponse
+	var ack bool
+	b := logger.PrepareSend("[LeaveRoom] request sent to server", clientID)
+	request := RoomRequest{clientID, "", b}
+	if err := r.doApiCall("TankServer.LeaveRoom", &request, &response); err != nil {
+		logger.UnpackReceive("[LeaveRoom] request rejected by server", response.B, &ack)
+		return err
+	}
+
+	logger.UnpackReceive("[LeaveRoom] request accepted by server", response.B, &ack)
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
 func (r *RPCServerAPI) Register(displayName string, clientID uint64, logger *govec.GoLog, useDinv bool) (clientlib.PeerNetSettings, error) {
 	var request RegisterRequest
 	b := logger.PrepareSend("[Resgiter] request sent to server", displayName)
@@ -266,6 +403,22 @@ func (r *RPCServerAPI) GetNodes(clientID uint64, logger *govec.GoLog, useDinv bo
 	return response.Nodes, nil
 }
 
+// Asks for peers that bridge us to players we can't hear from any more. Players
+// that are no longer in the game are left out.
+func (r *RPCServerAPI) GetBridges(clientID uint64, unreachable []uint64, logger *govec.GoLog) ([]PeerInfo, error) {
+	var response GetNodesResponse
+	var id uint64
+	b := logger.PrepareSend("[GetBridges] request sent to server", unreachable)
+	request := BridgeRequest{clientID, unreachable, b}
+	if err := r.doApiCall("TankServer.GetBridges", &request, &response); err != nil {
+		logger.UnpackReceive("[GetBridges] request rejected by server", response.B, &id)
+		return nil, err
+	}
+
+	logger.UnpackReceive("[GetBridges] request accepted by server", response.B, &id)
+	return response.Nodes, nil
+}
+
 func (r *RPCServerAPI) NotifyFailure(clientID uint64) error {
 	request := clientID
 	var ack bool
@@ -0,0 +1,47 @@
+package worldlib
+
+import (
+	"../clientlib"
+	"github.com/faiface/pixel"
+	"time"
+)
+
+type Bullet struct {
+	// Nonce of the FIRE update that fired it, which everyone knows it by
+	ID       uint64
+	PlayerID uint64
+	Pos      pixel.Vec
+	Angle    float64
+	// What fired it, how fast it goes, and for how long
+	Weapon   int
+	Speed    float64
+	Lifetime time.Duration
+	// Where and when it was fired, so we can tell where it was at any time
+	Origin pixel.Vec
+	Fired  time.Time
+}
+
+// The bullet a FIRE update fired, as if it was fired at fired
+func NewBullet(shot clientlib.Update, fired time.Time) *Bullet {
+	weapon, _ := WeaponFor(shot.Weapon)
+
+	return &Bullet{
+		ID:       shot.Nonce,
+		PlayerID: shot.PlayerID,
+		Pos:      shot.Pos,
+		Angle:    ShotAngle(shot),
+		Weapon:   shot.Weapon,
+		Speed:    weapon.Speed,
+		Lifetime: weapon.Lifetime(),
+		Origin:   shot.Pos,
+		Fired:    fired,
+	}
+}
+
+// Where the bullet was, or will be, at t on a map, and whether it was still
+// going then: it stops at walls, and once it runs out
+func (b *Bullet) At(m *Map, t time.Time) (pixel.Vec, bool) {
+	pos, going := m.Trajectory(b.Origin, b.Angle, b.Speed, t.Sub(b.Fired).Seconds())
+
+	return pos, going && t.Sub(b.Fired) <= b.Lifetime
+}
@@ -0,0 +1,79 @@
+package worldlib
+
+import (
+	"../clientlib"
+	"github.com/faiface/pixel"
+	"time"
+)
+
+const (
+	MaxHealth = 100
+	// How long a dead player waits before coming back
+	RespawnDelay = 3 * time.Second
+	// How long a player can't be hurt after coming back
+	SpawnInvulnerability = 2 * time.Second
+	// How far in from the edges the spawn points are
+	SpawnInset = 100.0
+)
+
+// The places players come back at on maps that don't say: the corners and the
+// middle
+func defaultSpawnPoints(bounds pixel.Rect) []pixel.Vec {
+	in := bounds.Min.Add(pixel.V(SpawnInset, SpawnInset))
+	out := bounds.Max.Sub(pixel.V(SpawnInset, SpawnInset))
+
+	return []pixel.Vec{
+		pixel.V(in.X, in.Y),
+		pixel.V(in.X, out.Y),
+		pixel.V(out.X, in.Y),
+		pixel.V(out.X, out.Y),
+		bounds.Center(),
+	}
+}
+
+// How much health a player has left, as far as has been committed
+func (w *World) Health(id uint64) int {
+	if _, dead := w.Fallen[id]; dead {
+		return 0
+	}
+
+	if health, ok := w.health[id]; ok {
+		return health
+	}
+	return MaxHealth
+}
+
+// Whether a player can't be hurt at t because it has only just spawned, or has
+// a shield up
+func (w *World) Invulnerable(id uint64, t time.Time) bool {
+	spawned, ok := w.spawned[id]
+	return (ok && t.Sub(spawned) < SpawnInvulnerability) || w.Shielded(id, t)
+}
+
+// Asks to come back once we've been dead long enough, at the spawn point
+// furthest from everyone else
+func (w *World) respawn(now time.Time) []clientlib.Update {
+	died, dead := w.Fallen[w.Local.ID]
+	if !dead || w.respawning || now.Sub(died) < RespawnDelay || w.Phase(now) == Running {
+		return nil
+	}
+
+	var best pixel.Vec
+	bestDistance := -1.0
+	for _, p := range w.Map.SpawnPoints() {
+		nearest := w.Bounds.Size().Len()
+		for _, id := range w.PlayerIDs {
+			if d := w.Players[id].Pos.Sub(p).Len(); d < nearest {
+				nearest = d
+			}
+		}
+
+		if nearest > bestDistance {
+			best = p
+			bestDistance = nearest
+		}
+	}
+
+	w.respawning = true
+	return []clientlib.Update{clientlib.Respawn(w.Local.ID, best).Timestamp(now)}
+}
@@ -0,0 +1,340 @@
+package worldlib
+
+import (
+	"fmt"
+	"github.com/faiface/pixel"
+	"hash/fnv"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+/*
+	Maps are text files, one directive per line. Lines starting with // are
+	comments.
+
+		size width height           how big the world is, from the origin
+		ricochet                    bullets bounce off walls instead of stopping
+		spawn x y                   a spawn point
+		rect x0 y0 x1 y1            a rectangular wall
+		wall x0 y0 x1 y1 x2 y2 ...  a polygonal wall, corners in order
+		tiles size                  a tile grid, size units to a side, with its
+		#..S                        rows following, top row first: # is a wall,
+		end                         S a spawn point, anything else is open
+
+	Everyone has to play on the same map, so peers compare hashes of their map
+	files when they register with each other.
+*/
+
+const (
+	// How big the world is on maps that don't say. It is bigger than the
+	// window, which follows the local player around.
+	DefaultWorldWidth  = 3072.0
+	DefaultWorldHeight = 2004.0
+	// How close the middle of a tank can get to a wall
+	TankRadius = 20.0
+	// How many times a bullet bounces on maps with ricochet, before it stops
+	MaxBounces = 3
+	// How far off a wall a bouncing bullet is put, so it doesn't hit it again
+	BounceGap = 0.01
+)
+
+// Contains a description of what was wrong, and where
+type MalformedMapError string
+
+func (e MalformedMapError) Error() string {
+	return fmt.Sprintf("Malformed map: %s", string(e))
+}
+
+// A wall is a closed polygon, corners in order
+type Wall []pixel.Vec
+
+type Map struct {
+	Walls  []Wall
+	Spawns []pixel.Vec
+	// How big the world is, or zero for the default size
+	Size pixel.Vec
+	// Whether bullets bounce off walls
+	Ricochet bool
+	// Hash of the map file. The empty map hashes to zero, so it matches peers
+	// that don't know about maps at all.
+	Hash uint64
+}
+
+// The open arena, with no walls
+func EmptyMap() *Map {
+	return &Map{}
+}
+
+func LoadMap(path string) (*Map, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseMap(data)
+}
+
+func ParseMap(data []byte) (*Map, error) {
+	hash := fnv.New64a()
+	hash.Write(data)
+
+	m := &Map{Hash: hash.Sum64()}
+	if m.Hash == 0 {
+		// Taken by the empty map
+		m.Hash = 1
+	}
+
+	lines := strings.Split(string(data), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == "" || strings.HasPrefix(line, "//") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		nums, err := parseNumbers(fields[1:])
+		if err != nil {
+			return nil, MalformedMapError(fmt.Sprintf("line %d: %s", i+1, err))
+		}
+
+		switch {
+		case fields[0] == "ricochet" && len(nums) == 0:
+			m.Ricochet = true
+		case fields[0] == "size" && len(nums) == 2 && nums[0] > 0 && nums[1] > 0:
+			m.Size = pixel.V(nums[0], nums[1])
+		case fields[0] == "spawn" && len(nums) == 2:
+			m.Spawns = append(m.Spawns, pixel.V(nums[0], nums[1]))
+		case fields[0] == "rect" && len(nums) == 4:
+			m.Walls = append(m.Walls, rectWall(pixel.R(nums[0], nums[1], nums[2], nums[3])))
+		case fields[0] == "wall" && len(nums) >= 6 && len(nums)%2 == 0:
+			var wall Wall
+			for j := 0; j < len(nums); j += 2 {
+				wall = append(wall, pixel.V(nums[j], nums[j+1]))
+			}
+			m.Walls = append(m.Walls, wall)
+		case fields[0] == "tiles" && len(nums) == 1 && nums[0] > 0:
+			end := i + 1
+			for end < len(lines) && strings.TrimSpace(lines[end]) != "end" {
+				end++
+			}
+			if end == len(lines) {
+				return nil, MalformedMapError(fmt.Sprintf("line %d: tiles without end", i+1))
+			}
+
+			m.addTiles(lines[i+1:end], nums[0])
+			i = end
+		default:
+			return nil, MalformedMapError(fmt.Sprintf("line %d: can't make sense of %q", i+1, line))
+		}
+	}
+
+	return m, nil
+}
+
+func parseNumbers(fields []string) ([]float64, error) {
+	nums := make([]float64, len(fields))
+	for i, field := range fields {
+		num, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return nil, err
+		}
+		nums[i] = num
+	}
+
+	return nums, nil
+}
+
+// Adds a grid of tiles, top row first, with the bottom row along y = 0. Runs
+// of wall tiles in a row become one wall.
+func (m *Map) addTiles(rows []string, size float64) {
+	for r, row := range rows {
+		y := float64(len(rows)-1-r) * size
+
+		start := -1
+		for c := 0; c <= len(row); c++ {
+			wall := c < len(row) && row[c] == '#'
+			if wall && start < 0 {
+				start = c
+			}
+			if !wall && start >= 0 {
+				m.Walls = append(m.Walls, rectWall(pixel.R(float64(start)*size, y, float64(c)*size, y+size)))
+				start = -1
+			}
+
+			if c < len(row) && row[c] == 'S' {
+				m.Spawns = append(m.Spawns, pixel.V((float64(c)+0.5)*size, y+size/2))
+			}
+		}
+	}
+}
+
+// The part of the world players can be in
+func (m *Map) Bounds() pixel.Rect {
+	if m.Size == pixel.ZV {
+		return pixel.R(0, 0, DefaultWorldWidth, DefaultWorldHeight)
+	}
+
+	return pixel.R(0, 0, m.Size.X, m.Size.Y)
+}
+
+func rectWall(r pixel.Rect) Wall {
+	return Wall{r.Min, pixel.V(r.Max.X, r.Min.Y), r.Max, pixel.V(r.Min.X, r.Max.Y)}
+}
+
+// Calls f with the ends of each side of the wall
+func (wall Wall) sides(f func(a, b pixel.Vec)) {
+	for i := range wall {
+		f(wall[i], wall[(i+1)%len(wall)])
+	}
+}
+
+// Whether a point is inside the wall, by counting the sides a ray from it crosses
+func (wall Wall) Contains(pos pixel.Vec) bool {
+	inside := false
+	wall.sides(func(a, b pixel.Vec) {
+		if (a.Y > pos.Y) != (b.Y > pos.Y) && pos.X < a.X+(pos.Y-a.Y)*(b.X-a.X)/(b.Y-a.Y) {
+			inside = !inside
+		}
+	})
+
+	return inside
+}
+
+// Whether a tank of the given radius at pos would be in a wall
+func (m *Map) Blocked(pos pixel.Vec, radius float64) bool {
+	for _, wall := range m.Walls {
+		if wall.Contains(pos) {
+			return true
+		}
+
+		blocked := false
+		wall.sides(func(a, b pixel.Vec) {
+			if segmentDistance(pos, a, b) < radius {
+				blocked = true
+			}
+		})
+		if blocked {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Whether going straight from one point to another goes through a wall
+func (m *Map) Crosses(from pixel.Vec, to pixel.Vec) bool {
+	_, _, hit := m.firstHit(from, to)
+	return hit
+}
+
+// Moves a tank of the given radius by delta, sliding along walls it runs into
+func (m *Map) Move(from pixel.Vec, delta pixel.Vec, radius float64) pixel.Vec {
+	if m.Blocked(from, radius) {
+		// Already stuck, so let it get out however it can
+		return from.Add(delta)
+	}
+
+	for _, step := range []pixel.Vec{delta, pixel.V(delta.X, 0), pixel.V(0, delta.Y)} {
+		to := from.Add(step)
+		if !m.Blocked(to, radius) && !m.Crosses(from, to) {
+			return to
+		}
+	}
+
+	return from
+}
+
+// Where a bullet fired from pos at angle and speed is after dt seconds, and
+// whether it is still going. Bullets stop at the first wall they hit, or bounce off it on maps
+// with ricochet, until they have bounced MaxBounces times.
+func (m *Map) Trajectory(pos pixel.Vec, angle float64, speed float64, dt float64) (pixel.Vec, bool) {
+	dir := pixel.Unit(angle)
+	left := dt * speed
+	if left <= 0 {
+		// Before it was fired, so walls don't come into it
+		return pos.Add(dir.Scaled(left)), true
+	}
+
+	for bounces := 0; ; bounces++ {
+		end := pos.Add(dir.Scaled(left))
+
+		t, normal, hit := m.firstHit(pos, end)
+		if !hit {
+			return end, true
+		}
+
+		at := pixel.Lerp(pos, end, t)
+		if !m.Ricochet || bounces == MaxBounces {
+			return at, false
+		}
+
+		// Reflect off the wall, from just in front of it
+		dir = dir.Sub(normal.Scaled(2 * dir.Dot(normal)))
+		left -= left * t
+		pos = at.Add(normal.Scaled(BounceGap))
+	}
+}
+
+// Finds the first wall side the segment from one point to another crosses. It
+// returns how far along the segment that is, from 0 to 1, and the side's normal
+// facing back towards from.
+func (m *Map) firstHit(from pixel.Vec, to pixel.Vec) (float64, pixel.Vec, bool) {
+	r := to.Sub(from)
+
+	first, hit := 2.0, false
+	var normal pixel.Vec
+	for _, wall := range m.Walls {
+		wall.sides(func(a, b pixel.Vec) {
+			s := b.Sub(a)
+			denom := r.Cross(s)
+			if denom == 0 {
+				// Parallel, so it can only graze along it
+				return
+			}
+
+			t := a.Sub(from).Cross(s) / denom
+			u := a.Sub(from).Cross(r) / denom
+			if t < 0 || t > 1 || u < 0 || u > 1 || t >= first {
+				return
+			}
+
+			first, hit = t, true
+			normal = s.Normal().Unit()
+			if normal.Dot(r) > 0 {
+				normal = normal.Scaled(-1)
+			}
+		})
+	}
+
+	return first, normal, hit
+}
+
+// How far a point is from the segment between a and b
+func segmentDistance(pos pixel.Vec, a pixel.Vec, b pixel.Vec) float64 {
+	s := b.Sub(a)
+	if s.Len() == 0 {
+		return pos.Sub(a).Len()
+	}
+
+	t := pixel.Clamp(pos.Sub(a).Dot(s)/s.Dot(s), 0, 1)
+	return pos.Sub(pixel.Lerp(a, b, t)).Len()
+}
+
+// The places players spawn at, which are the map's own if it has any
+func (m *Map) SpawnPoints() []pixel.Vec {
+	if len(m.Spawns) > 0 {
+		return m.Spawns
+	}
+
+	return defaultSpawnPoints(m.Bounds())
+}
+
+func (m *Map) IsSpawnPoint(pos pixel.Vec) bool {
+	for _, p := range m.SpawnPoints() {
+		if p == pos {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,255 @@
+package worldlib
+
+import (
+	"../clientlib"
+	"github.com/faiface/pixel"
+	"sort"
+	"time"
+)
+
+// Matches are last man standing. Once enough players are around, someone
+// proposes a START, and the first one committed counts down to the start of
+// the match; since everyone commits in the same order, and works the phase out
+// from synchronized time, everyone agrees on when it starts. Whoever is alive
+// by then plays. Nobody comes back until it's over, and the safe zone shrinks
+// to force the survivors together. The last one left wins.
+//
+// Nobody owns up to zone damage. Every client works it out for everyone at the
+// same times from committed positions, and commits it in between the other
+// updates, so it is the same everywhere. Players that crash never say they
+// have left, so those that have gone quiet leave the same way.
+
+type MatchPhase int
+
+const (
+	Lobby MatchPhase = iota
+	Countdown
+	Running
+	Finished
+)
+
+const (
+	MinMatchPlayers = 2
+	// How long there have to be enough players before we propose a match
+	LobbyWait = 3 * time.Second
+	// How often to propose again if nothing comes of it
+	ProposalInterval  = 5 * time.Second
+	CountdownDuration = 5 * time.Second
+	// How long the winner gets to gloat before it's back to the lobby
+	FinishedDuration = 10 * time.Second
+
+	// The safe zone shrinks from covering the whole arena to this over ZoneShrinkDuration
+	MinZoneRadius      = 100.0
+	ZoneShrinkDuration = 2 * time.Minute
+	// Players outside the zone take this much damage every ZoneDamageInterval
+	ZoneDamage         = 10
+	ZoneDamageInterval = time.Second
+	// How long a player can go without committing anything before it is taken
+	// to have left. Players repeat their position far more often than this.
+	SilentTimeout = 10 * time.Second
+)
+
+func (p MatchPhase) String() string {
+	switch p {
+	case Lobby:
+		return "lobby"
+	case Countdown:
+		return "countdown"
+	case Running:
+		return "running"
+	case Finished:
+		return "finished"
+	}
+	return "unknown"
+}
+
+// Committed match state
+type match struct {
+	// When the match starts, zero if none has been agreed on
+	start time.Time
+	// When it ended, zero if it hasn't
+	finished time.Time
+	winner   uint64
+	// Who is playing in it
+	participants map[uint64]bool
+	// When the zone last hurt everyone outside it
+	zoneDamaged time.Time
+}
+
+// The phase of the match at t
+func (w *World) Phase(t time.Time) MatchPhase {
+	m := &w.match
+
+	switch {
+	case m.start.IsZero():
+		return Lobby
+	case t.Before(m.start):
+		return Countdown
+	case m.finished.IsZero():
+		return Running
+	case t.Sub(m.finished) < FinishedDuration:
+		return Finished
+	}
+
+	return Lobby
+}
+
+// Who won the last match, zero if nobody has yet
+func (w *World) Winner() uint64 {
+	return w.match.winner
+}
+
+// The safe zone at t. Outside a running match the whole arena is safe.
+func (w *World) Zone(t time.Time) (center pixel.Vec, radius float64) {
+	center = w.Bounds.Center()
+	full := w.Bounds.Size().Len() / 2
+
+	if w.Phase(t) != Running {
+		return center, full
+	}
+
+	shrunk := t.Sub(w.match.start).Seconds() / ZoneShrinkDuration.Seconds()
+	if shrunk > 1 {
+		shrunk = 1
+	}
+
+	return center, full - (full-MinZoneRadius)*shrunk
+}
+
+func (w *World) InZone(pos pixel.Vec, t time.Time) bool {
+	center, radius := w.Zone(t)
+	return pos.Sub(center).Len() <= radius
+}
+
+// Proposes a match once enough players have been around for a while
+func (w *World) tickMatch(now time.Time) []clientlib.Update {
+	var out []clientlib.Update
+
+	switch w.Phase(now) {
+	case Lobby:
+		players := len(w.PlayerIDs)
+		if w.Alive {
+			players++
+		}
+
+		if players < MinMatchPlayers {
+			w.lobbySince = time.Time{}
+			break
+		}
+
+		if w.lobbySince.IsZero() {
+			w.lobbySince = now
+		}
+
+		if now.Sub(w.lobbySince) >= LobbyWait && now.Sub(w.lastProposal) >= ProposalInterval {
+			out = append(out, clientlib.StartMatch(w.Local.ID).Timestamp(now))
+			w.lastProposal = now
+		}
+	}
+
+	return out
+}
+
+// The updates the match makes by itself up to until, in the order to commit
+// them: every ZoneDamageInterval into the match, everyone playing who has gone
+// quiet leaves, and the rest whose last committed position is outside the zone
+// take a hit. Call it before committing each update, with the update's time,
+// so they fall in the same place everywhere.
+func (w *World) MatchUpdates(until time.Time) []clientlib.Update {
+	m := &w.match
+	if m.start.IsZero() {
+		return nil
+	}
+
+	next := m.start.Add(ZoneDamageInterval)
+	if !m.zoneDamaged.IsZero() {
+		next = m.zoneDamaged.Add(ZoneDamageInterval)
+	}
+
+	// Maps don't have a stable iteration order, and who dies first matters
+	var ids []uint64
+	for id := range m.participants {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var out []clientlib.Update
+	gone := make(map[uint64]bool)
+	for ; !next.After(until) && w.Phase(next) == Running; next = next.Add(ZoneDamageInterval) {
+		m.zoneDamaged = next
+
+		for _, id := range ids {
+			if _, dead := w.Fallen[id]; dead || gone[id] {
+				continue
+			}
+
+			if heard, ok := w.seen[id]; !ok || next.Sub(heard) > SilentTimeout {
+				out = append(out, clientlib.DeadPlayer(id, 0).Timestamp(next))
+				gone[id] = true
+				continue
+			}
+
+			pos, ok := w.positions[id]
+			if !ok || w.InZone(pos, next) {
+				continue
+			}
+
+			out = append(out, clientlib.DamagePlayer(id, 0, 0, ZoneDamage).Timestamp(next))
+		}
+	}
+
+	return out
+}
+
+// Commits a START proposal, if there isn't a match on already
+func (w *World) commitStart(update clientlib.Update) bool {
+	if w.Phase(update.Time) != Lobby {
+		return false
+	}
+
+	w.match = match{
+		start:        update.Time.Add(CountdownDuration),
+		participants: make(map[uint64]bool),
+	}
+
+	// Everyone we know to be alive is in
+	for id := range w.seen {
+		if _, dead := w.Fallen[id]; !dead {
+			w.match.participants[id] = true
+		}
+	}
+
+	return true
+}
+
+// Whether a player is playing in the match running at t. Outside a running
+// match, everybody is.
+func (w *World) playing(id uint64, t time.Time) bool {
+	return w.Phase(t) != Running || w.match.participants[id]
+}
+
+// Ends the match if at most one player is left standing. Returns whether it did.
+func (w *World) checkWinner(t time.Time) bool {
+	if w.Phase(t) != Running {
+		return false
+	}
+
+	var alive []uint64
+	for id := range w.match.participants {
+		if _, dead := w.Fallen[id]; !dead {
+			alive = append(alive, id)
+		}
+	}
+
+	if len(alive) > 1 {
+		return false
+	}
+
+	w.match.finished = t
+	w.match.winner = 0
+	if len(alive) == 1 {
+		w.match.winner = alive[0]
+	}
+
+	return true
+}
@@ -0,0 +1,193 @@
+package worldlib
+
+import (
+	"../clientlib"
+	"github.com/faiface/pixel"
+	"hash/fnv"
+	"math/rand"
+	"time"
+)
+
+// Pickups appear every PickupInterval of synchronized time, and lie there until
+// someone collects them or PickupLifetime runs out. Where each one appears, and
+// what it is, comes from its number and a seed everyone in the room shares, so
+// nobody has to announce them.
+//
+// A player that drives over a pickup claims it with a PICKUP update. Two players
+// may both claim the same one; whichever claim comes first in (Time, Nonce)
+// order gets it, so everyone agrees who did.
+
+type PickupKind int
+
+const (
+	HealthPickup PickupKind = iota
+	SpeedPickup
+	ShieldPickup
+	AmmoPickup
+
+	pickupKinds = iota
+)
+
+const (
+	PickupInterval = 10 * time.Second
+	PickupLifetime = 30 * time.Second
+	// How close a tank has to get to collect a pickup
+	PickupRadius = 25.0
+	// How much health a health pickup gives back
+	PickupHealth = 50
+	// How much faster a speed pickup makes a tank go. Validators allow for up
+	// to twice PlayerSpeed, which a boosted tank going diagonally stays under.
+	SpeedBoost         = 1.3
+	SpeedBoostDuration = 8 * time.Second
+	// How long a shield keeps a tank from being hurt
+	ShieldDuration = 5 * time.Second
+	// How many places to try for a pickup before giving up on that number
+	pickupPlacements = 10
+)
+
+func (k PickupKind) String() string {
+	switch k {
+	case HealthPickup:
+		return "health"
+	case SpeedPickup:
+		return "speed"
+	case ShieldPickup:
+		return "shield"
+	case AmmoPickup:
+		return "ammo"
+	}
+	return "unknown"
+}
+
+type Pickup struct {
+	// Which PickupInterval it appeared in, counted from the Unix epoch
+	ID      uint64
+	Kind    PickupKind
+	Pos     pixel.Vec
+	Spawned time.Time
+}
+
+// Whether the pickup is lying there to be collected at t, unless someone has
+func (p Pickup) Available(t time.Time) bool {
+	return !t.Before(p.Spawned) && t.Sub(p.Spawned) < PickupLifetime
+}
+
+// The seed for everyone in a room, playing on a map
+func PickupSeed(room string, m *Map) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(room))
+
+	return hash.Sum64() ^ m.Hash
+}
+
+// Works out pickup number id. It returns false if there is no room for it.
+func SpawnPickup(seed uint64, m *Map, id uint64) (Pickup, bool) {
+	rng := rand.New(rand.NewSource(int64(seed ^ (id * 0x9E3779B97F4A7C15))))
+	bounds := m.Bounds()
+
+	pickup := Pickup{
+		ID:      id,
+		Kind:    PickupKind(rng.Intn(pickupKinds)),
+		Spawned: time.Unix(0, int64(id)*int64(PickupInterval)),
+	}
+
+	for i := 0; i < pickupPlacements; i++ {
+		pickup.Pos = pixel.V(
+			bounds.Min.X+rng.Float64()*bounds.W(),
+			bounds.Min.Y+rng.Float64()*bounds.H(),
+		)
+
+		if !m.Blocked(pickup.Pos, PickupRadius) {
+			return pickup, true
+		}
+	}
+
+	return Pickup{}, false
+}
+
+// The pickups lying around at now that nobody has collected, as far as has
+// been committed
+func (w *World) Pickups(now time.Time) []Pickup {
+	var pickups []Pickup
+
+	last := uint64(now.UnixNano() / int64(PickupInterval))
+	for id := last; id+uint64(PickupLifetime/PickupInterval) > last; id-- {
+		if _, taken := w.collected[id]; taken {
+			continue
+		}
+
+		if pickup, ok := SpawnPickup(w.PickupSeed, w.Map, id); ok && pickup.Available(now) {
+			pickups = append(pickups, pickup)
+		}
+	}
+
+	return pickups
+}
+
+// How much faster than normal a player goes at t
+func (w *World) SpeedFactor(id uint64, t time.Time) float64 {
+	if t.Before(w.boosted[id]) {
+		return SpeedBoost
+	}
+	return 1
+}
+
+// Whether a player is shielded at t
+func (w *World) Shielded(id uint64, t time.Time) bool {
+	return t.Before(w.shielded[id])
+}
+
+// Claims whatever pickups the local player is on
+func (w *World) claimPickups(now time.Time) []clientlib.Update {
+	var out []clientlib.Update
+
+	for _, pickup := range w.Pickups(now) {
+		if w.claimed[pickup.ID] || w.Local.Pos.Sub(pickup.Pos).Len() > PickupRadius {
+			continue
+		}
+
+		w.claimed[pickup.ID] = true
+		out = append(out, clientlib.CollectPickup(w.Local.ID, pickup.ID, pickup.Pos).Timestamp(now))
+	}
+
+	return out
+}
+
+// Settles a claim on a pickup. Only the first claim on each one counts.
+func (w *World) commitPickup(update clientlib.Update) bool {
+	if _, taken := w.collected[update.Ref]; taken {
+		return false
+	}
+
+	pickup, ok := SpawnPickup(w.PickupSeed, w.Map, update.Ref)
+	if !ok || !pickup.Available(update.Time) {
+		return false
+	}
+
+	w.collected[update.Ref] = update.PlayerID
+	for id := range w.collected {
+		if id+uint64(PickupLifetime/PickupInterval) < update.Ref {
+			// Long gone anyway
+			delete(w.collected, id)
+			delete(w.claimed, id)
+		}
+	}
+
+	switch pickup.Kind {
+	case HealthPickup:
+		w.health[update.PlayerID] = w.Health(update.PlayerID) + PickupHealth
+		if w.health[update.PlayerID] > MaxHealth {
+			w.health[update.PlayerID] = MaxHealth
+		}
+	case SpeedPickup:
+		w.boosted[update.PlayerID] = update.Time.Add(SpeedBoostDuration)
+	case ShieldPickup:
+		w.shielded[update.PlayerID] = update.Time.Add(ShieldDuration)
+	case AmmoPickup:
+		if update.PlayerID == w.Local.ID {
+			w.rearm()
+		}
+	}
+
+	return true
+}
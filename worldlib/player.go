@@ -0,0 +1,91 @@
+package worldlib
+
+import (
+	"../clientlib"
+	"github.com/faiface/pixel"
+	"time"
+)
+
+const (
+	PlayerHitBounds = 25.0
+)
+
+type Player struct {
+	ID    uint64
+	Pos   pixel.Vec
+	Angle float64
+	// When the player was at Pos
+	Time time.Time
+	// About how long its updates take to reach us, so how far in the past we
+	// see it
+	Latency time.Duration
+	// Where to show the player. For remote players this is smoothed, so it
+	// lags a little behind Pos; see Smoother.
+	Shown    pixel.Vec
+	smoother *Smoother
+}
+
+func NewPlayer(id uint64) *Player {
+	return &Player{
+		ID: id,
+	}
+}
+
+// A player we only hear about through updates, which are smoothed out
+func NewRemotePlayer(id uint64) *Player {
+	return &Player{
+		ID:       id,
+		smoother: &Smoother{},
+	}
+}
+
+func (p *Player) Update() clientlib.Update {
+	return clientlib.Update{
+		Kind:     clientlib.POSITION,
+		PlayerID: p.ID,
+		Pos:      p.Pos,
+		Angle:    p.Angle,
+	}
+}
+
+func (p *Player) Accept(update clientlib.Update) {
+	switch update.Kind {
+	case clientlib.POSITION:
+		p.Pos = update.Pos
+		p.Angle = update.Angle
+		p.Time = update.Time
+
+		if p.smoother != nil {
+			p.smoother.Add(update)
+		} else {
+			p.Shown = p.Pos
+		}
+	}
+}
+
+// Takes the delay of a position update that arrived at now into the latency
+// estimate. It is smoothed, so one slow update doesn't throw it.
+func (p *Player) measureLatency(update clientlib.Update, now time.Time) {
+	delay := now.Sub(update.Time)
+	if delay < 0 {
+		delay = 0
+	}
+
+	if p.Latency == 0 {
+		p.Latency = delay
+	} else {
+		p.Latency += (delay - p.Latency) / 4
+	}
+}
+
+// Moves where the player is shown along by dt seconds
+func (p *Player) Smooth(dt float64, now time.Time) {
+	if p.smoother != nil {
+		p.Shown = p.smoother.Step(dt, now)
+	}
+}
+
+// Whether a point is close enough to this player to hit it
+func (p *Player) Hit(pos pixel.Vec) bool {
+	return pos.Sub(p.Pos).Len() < PlayerHitBounds
+}
@@ -0,0 +1,98 @@
+package worldlib
+
+import (
+	"../clientlib"
+	"github.com/faiface/pixel"
+	"time"
+)
+
+const (
+	// Remote players are shown this far in the past, so there is usually an
+	// update on either side of the moment shown to interpolate between
+	InterpolationDelay = 100 * time.Millisecond
+	// How far past the last update a player is extrapolated before it is left
+	// where it was heading
+	MaxExtrapolation = 250 * time.Millisecond
+	// How fast the shown position may catch up with where a player should be,
+	// in units per second. Keeps corrections from being jumps.
+	MaxCorrectionSpeed = 3 * clientlib.PlayerSpeed
+	// Corrections bigger than this are jumps anyway; don't drag them out
+	SnapDistance = 4 * PlayerHitBounds
+)
+
+// Works out where to show a remote player from the position updates it sends.
+// It interpolates between the last two, extrapolates along the player's velocity
+// when updates go missing, and eases in corrections when they turn up again.
+type Smoother struct {
+	prev, last clientlib.Update
+	samples    int
+	// Where the player is shown
+	Pos pixel.Vec
+}
+
+// Adds a position update. Updates older than the latest are only used to
+// interpolate from.
+func (s *Smoother) Add(update clientlib.Update) {
+	switch {
+	case s.samples == 0:
+		s.last = update
+		s.Pos = update.Pos
+	case update.Time.After(s.last.Time):
+		s.prev = s.last
+		s.last = update
+	case update.Time.After(s.prev.Time):
+		s.prev = update
+	default:
+		return
+	}
+
+	s.samples++
+}
+
+// Where the player should be shown at now, without easing
+func (s *Smoother) Target(now time.Time) pixel.Vec {
+	if s.samples == 0 {
+		return s.Pos
+	}
+
+	at := now.Add(-InterpolationDelay)
+
+	if s.samples > 1 && at.Before(s.last.Time) {
+		if !at.After(s.prev.Time) {
+			return s.prev.Pos
+		}
+
+		span := s.last.Time.Sub(s.prev.Time).Seconds()
+		if span <= 0 {
+			return s.last.Pos
+		}
+
+		t := at.Sub(s.prev.Time).Seconds() / span
+		return pixel.Lerp(s.prev.Pos, s.last.Pos, t)
+	}
+
+	ahead := at.Sub(s.last.Time)
+	if ahead > MaxExtrapolation {
+		ahead = MaxExtrapolation
+	}
+	if ahead < 0 {
+		ahead = 0
+	}
+
+	return s.last.Pos.Add(s.last.Vel.Scaled(ahead.Seconds()))
+}
+
+// Moves the shown position towards the target by at most a bounded correction
+func (s *Smoother) Step(dt float64, now time.Time) pixel.Vec {
+	target := s.Target(now)
+	diff := target.Sub(s.Pos)
+
+	maxStep := MaxCorrectionSpeed * dt
+	if diff.Len() <= maxStep || diff.Len() > SnapDistance {
+		s.Pos = target
+	} else {
+		s.Pos = s.Pos.Add(diff.Unit().Scaled(maxStep))
+	}
+
+	return s.Pos
+}
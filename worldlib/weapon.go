@@ -0,0 +1,165 @@
+package worldlib
+
+import (
+	"../clientlib"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Tanks carry every weapon, each with its own magazine. FIRE updates say which
+// one fired, and everyone checks the shooter kept to its fire rate and ammo.
+//
+// Weapons spread their shots, but not at random: how far a shot strays from
+// where the tank aimed comes from who fired it and how many shots it has fired
+// before, so everyone sends the bullet the same way. Shots are numbered one
+// after another, and skipping ahead to a better stray costs the shooter as
+// much time as firing those shots would have; see checkFire in the client.
+
+const (
+	Cannon = iota
+	MachineGun
+	Rifle
+)
+
+type Weapon struct {
+	Name string
+	// How fast its bullets go, in units per second, and how far
+	Speed float64
+	Range float64
+	// How far a shot may stray either side of where the tank aims, in radians
+	Spread float64
+	// How much health a hit takes away
+	Damage int
+	// How long after a shot until the next, and how long reloading takes
+	Cooldown time.Duration
+	Reload   time.Duration
+	// How many shots a full magazine holds
+	Magazine int
+}
+
+var Weapons = []Weapon{
+	Cannon: {
+		Name:     "cannon",
+		Speed:    200,
+		Range:    900,
+		Spread:   0.02,
+		Damage:   25,
+		Cooldown: 500 * time.Millisecond,
+		Reload:   2 * time.Second,
+		Magazine: 6,
+	},
+	MachineGun: {
+		Name:     "machine gun",
+		Speed:    350,
+		Range:    700,
+		Spread:   0.12,
+		Damage:   8,
+		Cooldown: 100 * time.Millisecond,
+		Reload:   3 * time.Second,
+		Magazine: 30,
+	},
+	Rifle: {
+		Name:     "rifle",
+		Speed:    600,
+		Range:    1800,
+		Spread:   0,
+		Damage:   50,
+		Cooldown: 1500 * time.Millisecond,
+		Reload:   3 * time.Second,
+		Magazine: 3,
+	},
+}
+
+// Contains the weapon number
+type UnknownWeaponError int
+
+func (e UnknownWeaponError) Error() string {
+	return fmt.Sprintf("Unknown weapon %d", int(e))
+}
+
+func WeaponFor(kind int) (Weapon, error) {
+	if kind < 0 || kind >= len(Weapons) {
+		return Weapon{}, UnknownWeaponError(kind)
+	}
+
+	return Weapons[kind], nil
+}
+
+// How long its bullets fly before they run out
+func (weapon Weapon) Lifetime() time.Duration {
+	return time.Duration(weapon.Range / weapon.Speed * float64(time.Second))
+}
+
+// Which way the bullet from a FIRE update goes: where the tank aimed, strayed
+// by up to the weapon's spread
+func ShotAngle(shot clientlib.Update) float64 {
+	weapon, err := WeaponFor(shot.Weapon)
+	if err != nil {
+		return shot.Angle
+	}
+
+	rng := rand.New(rand.NewSource(int64(shot.PlayerID*0x9E3779B97F4A7C15 ^ shot.Seq)))
+	stray := rng.Float64()*2 - 1
+
+	return shot.Angle + stray*weapon.Spread
+}
+
+// Which weapon the local player has out, and how many shots are left in it
+func (w *World) Weapon() (int, int) {
+	return w.weapon, w.ammo[w.weapon]
+}
+
+// Whether the local player is reloading at now
+func (w *World) Reloading(now time.Time) bool {
+	return now.Before(w.reloaded)
+}
+
+// Switches weapons, reloads and fires as the input says
+func (w *World) handleWeapon(input Input, now time.Time) []clientlib.Update {
+	if !w.reloaded.IsZero() && !now.Before(w.reloaded) {
+		// Done reloading
+		w.ammo[w.weapon] = Weapons[w.weapon].Magazine
+		w.reloaded = time.Time{}
+	}
+
+	if input.Weapon != nil && *input.Weapon != w.weapon {
+		if _, err := WeaponFor(*input.Weapon); err == nil {
+			// Putting the weapon away stops it reloading
+			w.weapon = *input.Weapon
+			w.reloaded = time.Time{}
+		}
+	}
+
+	weapon := Weapons[w.weapon]
+	if input.Reload && w.reloaded.IsZero() && w.ammo[w.weapon] < weapon.Magazine {
+		w.reloaded = now.Add(weapon.Reload)
+	}
+
+	if !input.Fire || w.Reloading(now) || w.ammo[w.weapon] == 0 || now.Sub(w.lastShot) < weapon.Cooldown {
+		return nil
+	}
+
+	out := w.fire(now)
+	if len(out) == 0 {
+		return nil
+	}
+
+	w.lastShot = now
+	w.ammo[w.weapon]--
+	if w.ammo[w.weapon] == 0 {
+		// Reload by itself when it runs dry
+		w.reloaded = now.Add(weapon.Reload)
+	}
+
+	return out
+}
+
+// Fills every magazine, as when spawning
+func (w *World) rearm() {
+	w.ammo = make([]int, len(Weapons))
+	for i, weapon := range Weapons {
+		w.ammo[i] = weapon.Magazine
+	}
+	w.reloaded = time.Time{}
+}
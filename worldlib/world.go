@@ -0,0 +1,697 @@
+/*
+	Implements the game rules for P2P Battle Tanks without any rendering.
+
+	A World is driven by local input through Tick and by updates from other
+	players through Accept. Neither touches a window or the network, so the
+	same World can back the pixel front end, the bot, or a headless test.
+
+	Accept shows updates as soon as they arrive. Commit settles what they
+	mean, such as who gets credit for a kill; it must be fed updates in the
+	(Time, Nonce) order every client agrees on, so that everyone settles
+	them the same way.
+
+	Everyone sees remote players where they last said they were, which is a
+	little in the past, so hits on them are checked against where bullets were
+	back then. Bullets are worked out from where and when they were fired, so
+	those from remote players are wherever they have got to by the time their
+	FIRE update gets here, and every client sees them in the same place.
+
+	Walls on the map block tanks and bullets; see map.go.
+
+	The local player moves as soon as input comes in. Each input is numbered
+	and kept for a while, and if a peer rejects where it took us, we go back to
+	the last position the peer accepted and replay the inputs since.
+
+	Nobody decides alone that a player was hit. Every World claims the hits
+	it sees, on anyone, and it is up to the caller to confirm a hit once
+	enough players agree on it, and commit the damage it does. Players die
+	when their health runs out, and come back at a spawn point a little later,
+	unless a match is on; see match.go.
+
+	Bullets are known everywhere by the nonce of the FIRE update that fired
+	them. A bullet is gone once it hits someone, and if hits by the same
+	bullet on two players are both confirmed, only the first one committed
+	counts, so everyone agrees on which bullet hurt whom.
+
+	Pickups turn up in the same places for everyone, and go to whoever
+	claims them first; see pickup.go.
+*/
+
+package worldlib
+
+import (
+	"../clientlib"
+	"github.com/faiface/pixel"
+	"math"
+	"time"
+)
+
+const (
+	// How far in front of the tank a bullet appears
+	BarrelLength = 30.0
+	// How often to repeat our position when it hasn't changed, so new peers
+	// still hear about us
+	PositionRefreshInterval = time.Second
+	// How far back hit checks look. Players we haven't heard from for longer
+	// are checked where they are now.
+	MaxRewind = 500 * time.Millisecond
+	// How far remote bullets are moved on to make up for network delay
+	MaxLagCompensation = time.Second
+	// How long local inputs are kept for replay. Validators drop updates older
+	// than this, so nothing older can be corrected.
+	PredictionWindow = time.Second
+	// How far a correction may be from where we think we were at that input
+	CorrectionTolerance = 1.0
+	// How long to remember which bullets have hit someone, which is longer
+	// than any of them fly
+	SpentMemory = 10 * time.Second
+)
+
+// A single frame of input for the local player
+type Input struct {
+	// Velocity to move at, in units per second
+	Move pixel.Vec
+	// Angle to face
+	Angle float64
+	// Fire a bullet this tick
+	Fire bool
+	// Reload, or switch to another weapon if set
+	Reload bool
+	Weapon *int
+	// If set, jump straight to this position (bad behavior, useful to test validation)
+	Warp *pixel.Vec
+}
+
+type World struct {
+	Bounds pixel.Rect
+	Map    *Map
+	Local  *Player
+	Alive  bool
+	// When we last told everyone where we are, and how fast we were going
+	lastPositionSent time.Time
+	lastVelSent      pixel.Vec
+	// Sequence number of the last input applied, and the inputs that could
+	// still be corrected, oldest first
+	seq     uint64
+	pending []pendingInput
+	// The weapon out, what's left in each magazine, when we last fired, and
+	// when we'll be done reloading, zero if we aren't; see weapon.go
+	weapon   int
+	ammo     []int
+	lastShot time.Time
+	reloaded time.Time
+	// How many shots we have fired, which numbers each one
+	shots uint64
+
+	Players map[uint64]*Player
+	// Keep a separate list of player IDs around because go maps don't have a stable iteration order
+	PlayerIDs []uint64
+	Bullets   []*Bullet
+	// When players left, so updates sent before then don't bring them back.
+	// They can come back afterwards under the same ID.
+	left map[uint64]time.Time
+
+	// Committed state. When dead players died, how much health the living
+	// have, when they last spawned, and where they last said they were.
+	Fallen     map[uint64]time.Time
+	health     map[uint64]int
+	spawned    map[uint64]time.Time
+	positions  map[uint64]pixel.Vec
+	respawning bool
+	// Bullets that have hit someone, and when
+	spent map[uint64]time.Time
+	// Who collected each pickup, and until when players are sped up or
+	// shielded by them; see pickup.go
+	collected map[uint64]uint64
+	boosted   map[uint64]time.Time
+	shielded  map[uint64]time.Time
+	// Pickups we have claimed, whether or not we got them
+	claimed map[uint64]bool
+	// Shared by everyone in the room, to place pickups the same way
+	PickupSeed uint64
+	// Everyone we have committed anything from, and when they last sent
+	// anything, and the match
+	seen  map[uint64]time.Time
+	match match
+
+	lobbySince   time.Time
+	lastProposal time.Time
+}
+
+// A local input, kept in case it has to be replayed
+type pendingInput struct {
+	seq  uint64
+	time time.Time
+	// How far it moved us, or that it warped us somewhere
+	move pixel.Vec
+	warp bool
+	// Where it left us
+	pos pixel.Vec
+}
+
+// What a committed update turned out to mean
+type Outcome struct {
+	// Whether the update took effect at all
+	Counted bool
+	// Whether the update killed someone, who gets the credit, zero if nobody,
+	// and the ID of the bullet that did it, zero if none did
+	Died   bool
+	Killer uint64
+	Bullet uint64
+	// Whether the update was a player leaving the game
+	Left bool
+	// Whether the update ended the match, and who won, zero if nobody did
+	Finished bool
+	Winner   uint64
+}
+
+func NewWorld(localID uint64, m *Map) *World {
+	bounds := m.Bounds()
+
+	local := NewPlayer(localID)
+	local.Pos = bounds.Center()
+	if len(m.Spawns) > 0 {
+		// The middle may well be in a wall, so spread out over the spawn points
+		local.Pos = m.Spawns[localID%uint64(len(m.Spawns))]
+	}
+	local.Shown = local.Pos
+
+	w := &World{
+		Bounds:  bounds,
+		Map:     m,
+		Local:   local,
+		Alive:   true,
+		Players: make(map[uint64]*Player),
+		left:    make(map[uint64]time.Time),
+		Fallen:  make(map[uint64]time.Time),
+		health:  make(map[uint64]int),
+		spawned: make(map[uint64]time.Time),
+		spent:   make(map[uint64]time.Time),
+		seen:    make(map[uint64]time.Time),
+
+		positions: make(map[uint64]pixel.Vec),
+		collected: make(map[uint64]uint64),
+		boosted:   make(map[uint64]time.Time),
+		shielded:  make(map[uint64]time.Time),
+		claimed:   make(map[uint64]bool),
+	}
+	w.rearm()
+
+	return w
+}
+
+// Advances the world by dt seconds and applies local input. Returns the updates
+// the local player produced, including claims for hits it saw, which should be
+// sent to everybody else.
+func (w *World) Tick(dt float64, input Input, now time.Time) []clientlib.Update {
+	var out []clientlib.Update
+
+	// Update existing bullets
+	out = append(out, w.updateBullets(dt, now)...)
+
+	// Move remote players along between their updates
+	for _, id := range w.PlayerIDs {
+		w.Players[id].Smooth(dt, now)
+	}
+
+	// Update the local player with local input, if we're alive
+	if w.Alive {
+		out = append(out, w.applyInput(dt, input, now)...)
+		out = append(out, w.claimPickups(now)...)
+	} else {
+		out = append(out, w.respawn(now)...)
+	}
+
+	out = append(out, w.tickMatch(now)...)
+
+	return out
+}
+
+// Moves bullets along, and claims the hits they make. A bullet is gone once it
+// hits someone, runs out, or is stopped by a wall.
+func (w *World) updateBullets(dt float64, now time.Time) []clientlib.Update {
+	since := now.Add(-time.Duration(dt * float64(time.Second)))
+
+	var out []clientlib.Update
+
+	live := w.Bullets[:0]
+	for _, bullet := range w.Bullets {
+		pos, going := bullet.At(w.Map, now)
+		bullet.Pos = pos
+
+		if !going || !w.Bounds.Contains(bullet.Pos) {
+			// kill this bullet
+			continue
+		}
+
+		targets := w.PlayerIDs
+		if w.Alive {
+			targets = append([]uint64{w.Local.ID}, targets...)
+		}
+
+		hit := false
+		for _, id := range targets {
+			player := w.Local
+			if id != w.Local.ID {
+				player = w.Players[id]
+			}
+
+			if claim, ok := w.claimHit(bullet, player, since, now); ok {
+				out = append(out, claim)
+				hit = true
+				break
+			}
+		}
+
+		if !hit {
+			live = append(live, bullet)
+		}
+	}
+	w.Bullets = live
+
+	return out
+}
+
+// Claims a hit if the bullet crossed a player between since and now. We see
+// remote players as they were about their latency ago, so the bullet's path
+// is rewound by that much before it is checked against them; the whole path
+// is swept, so it can't skip over a player between frames.
+func (w *World) claimHit(bullet *Bullet, player *Player, since time.Time, now time.Time) (clientlib.Update, bool) {
+	if bullet.PlayerID == player.ID {
+		return clientlib.Update{}, false
+	}
+
+	rewind := player.Latency
+	if rewind > MaxRewind {
+		rewind = MaxRewind
+	}
+
+	from, to := since.Add(-rewind), now.Add(-rewind)
+	if from.Before(bullet.Fired) {
+		from = bullet.Fired
+	}
+
+	// Small enough steps that the bullet can't jump over anyone
+	step := time.Duration(PlayerHitBounds / bullet.Speed * float64(time.Second))
+	if step <= 0 {
+		step = time.Millisecond
+	}
+
+	for at := from; !at.After(to); at = at.Add(step) {
+		pos, going := bullet.At(w.Map, at)
+		if !going {
+			break
+		}
+		if !player.Hit(pos) {
+			continue
+		}
+
+		claim := clientlib.HitClaim(w.Local.ID, player.ID, bullet.ID, pos).Timestamp(now)
+		claim.Time = at
+		return claim, true
+	}
+
+	return clientlib.Update{}, false
+}
+
+func (w *World) hasBullet(id uint64) bool {
+	if _, ok := w.spent[id]; ok {
+		return true
+	}
+
+	for _, bullet := range w.Bullets {
+		if bullet.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Marks a bullet as having hit someone at t, and takes it out of the world.
+// Returns false if it already had.
+func (w *World) spend(id uint64, t time.Time) bool {
+	if _, ok := w.spent[id]; ok {
+		return false
+	}
+
+	w.spent[id] = t
+	w.removeBullet(id)
+
+	for other, at := range w.spent {
+		if t.Sub(at) > SpentMemory {
+			delete(w.spent, other)
+		}
+	}
+
+	return true
+}
+
+// Takes a bullet out of the world, wherever it has got to
+func (w *World) removeBullet(id uint64) {
+	for i, bullet := range w.Bullets {
+		if bullet.ID == id {
+			w.Bullets = append(w.Bullets[:i], w.Bullets[i+1:]...)
+			return
+		}
+	}
+}
+
+func (w *World) applyInput(dt float64, input Input, now time.Time) []clientlib.Update {
+	move := input.Move.Scaled(dt * w.SpeedFactor(w.Local.ID, now))
+
+	update := w.Local.Update()
+	update.Pos = w.Map.Move(update.Pos, move, TankRadius)
+	if input.Warp != nil {
+		update.Pos = *input.Warp
+	}
+	update.Angle = input.Angle
+
+	update = update.Bound(w.Bounds).Timestamp(now)
+
+	w.seq++
+	update.Seq = w.seq
+	w.remember(pendingInput{
+		seq:  w.seq,
+		time: now,
+		move: move,
+		warp: input.Warp != nil,
+		pos:  update.Pos,
+	}, now)
+
+	// Tell everyone how fast we're really going, after bumping into walls and
+	// the edges, so they can guess where we are between updates
+	if input.Warp == nil && dt > 0 {
+		update.Vel = update.Pos.Sub(w.Local.Pos).Scaled(1 / dt)
+	}
+
+	var out []clientlib.Update
+	if update.Pos != w.Local.Pos || update.Angle != w.Local.Angle || update.Vel != w.lastVelSent ||
+		now.Sub(w.lastPositionSent) >= PositionRefreshInterval {
+		// Only tell everyone if something changed
+		out = append(out, update)
+		w.lastPositionSent = now
+		w.lastVelSent = update.Vel
+	}
+
+	// Update our local player immediately
+	w.Local.Accept(update)
+
+	out = append(out, w.handleWeapon(input, now)...)
+
+	return out
+}
+
+func (w *World) remember(input pendingInput, now time.Time) {
+	w.pending = append(w.pending, input)
+
+	fence := now.Add(-PredictionWindow)
+	for len(w.pending) > 0 && w.pending[0].time.Before(fence) {
+		w.pending = w.pending[1:]
+	}
+}
+
+// Puts the local player back where a peer last accepted it, and replays every
+// input since, except warps, which are what get rejected. Corrections that
+// don't match where we were are ignored, so a peer can't move us anywhere we
+// haven't been.
+func (w *World) reconcile(correction clientlib.Update) bool {
+	base := -1
+	for i, input := range w.pending {
+		if input.seq == correction.Seq {
+			base = i
+			break
+		}
+	}
+
+	if base < 0 || w.pending[base].pos.Sub(correction.Pos).Len() > CorrectionTolerance {
+		return false
+	}
+
+	pos := w.pending[base].pos
+	for i := base + 1; i < len(w.pending); i++ {
+		if !w.pending[i].warp {
+			pos = w.bound(w.Map.Move(pos, w.pending[i].move, TankRadius))
+		}
+		w.pending[i].pos = pos
+	}
+
+	w.Local.Pos = pos
+	w.Local.Shown = pos
+
+	// Tell everyone where we really are straight away
+	w.lastPositionSent = time.Time{}
+
+	return true
+}
+
+func (w *World) bound(pos pixel.Vec) pixel.Vec {
+	return pixel.V(
+		pixel.Clamp(pos.X, w.Bounds.Min.X, w.Bounds.Max.X),
+		pixel.Clamp(pos.Y, w.Bounds.Min.Y, w.Bounds.Max.Y),
+	)
+}
+
+func (w *World) fire(now time.Time) []clientlib.Update {
+	offset := pixel.V(math.Cos(w.Local.Angle), math.Sin(w.Local.Angle)).Scaled(BarrelLength)
+	position := w.Local.Pos.Add(offset)
+
+	if w.Map.Crosses(w.Local.Pos, position) {
+		// The barrel is through a wall, and nobody gets to shoot through walls
+		return nil
+	}
+
+	w.shots++
+	update := clientlib.FireBullet(w.Local.ID, position, w.Local.Angle, w.weapon).Timestamp(now)
+	update.Seq = w.shots
+
+	// Add the bullet to our list
+	w.Bullets = append(w.Bullets, NewBullet(update, now))
+
+	return []clientlib.Update{update}
+}
+
+// Applies an update from another player
+func (w *World) Accept(update clientlib.Update, now time.Time) {
+	if update.PlayerID == w.Local.ID {
+		// We already know about ourselves
+		return
+	}
+
+	if _, dead := w.Fallen[update.PlayerID]; dead {
+		// Stragglers from before they died
+		return
+	}
+	if left, ok := w.left[update.PlayerID]; ok && !update.Time.After(left) {
+		// Stragglers from before they left
+		return
+	}
+
+	if w.Players[update.PlayerID] == nil {
+		// New player, create it
+		w.Players[update.PlayerID] = NewRemotePlayer(update.PlayerID)
+		w.PlayerIDs = append(w.PlayerIDs, update.PlayerID)
+	}
+
+	switch update.Kind {
+	case clientlib.DEAD:
+		// Remove the player if they're dead
+		w.removePlayer(update.PlayerID)
+		w.left[update.PlayerID] = update.Time
+	case clientlib.FIRE:
+		// Add a bullet, which is wherever it has got to by now, unless the
+		// update took so long that it would look like it came from nowhere
+		fired := update.Time
+		if now.Sub(fired) > MaxLagCompensation {
+			fired = now
+		}
+		if !w.hasBullet(update.Nonce) {
+			w.Bullets = append(w.Bullets, NewBullet(update, fired))
+		}
+	case clientlib.HIT, clientlib.DAMAGE, clientlib.RESPAWN, clientlib.PICKUP:
+		// These only mean anything once they're committed
+	case clientlib.CORRECTION:
+		if update.OtherPlayer == w.Local.ID && w.Alive {
+			w.reconcile(update)
+		}
+	case clientlib.POSITION:
+		w.Players[update.PlayerID].measureLatency(update, now)
+		w.Players[update.PlayerID].Accept(update)
+	default:
+		w.Players[update.PlayerID].Accept(update)
+	}
+}
+
+// Settles an update, in agreed order. Dead players can't do anything, so of two
+// players who shoot each other at once, only the one who died second gets the kill.
+func (w *World) Commit(update clientlib.Update) Outcome {
+	died, dead := w.Fallen[update.PlayerID]
+
+	if update.Kind == clientlib.RESPAWN {
+		if !dead || update.Time.Sub(died) < RespawnDelay || !w.Map.IsSpawnPoint(update.Pos) ||
+			w.Phase(update.Time) == Running {
+			return Outcome{}
+		}
+
+		w.revive(update)
+		return Outcome{Counted: true}
+	}
+
+	if update.Kind == clientlib.DEAD {
+		// The dead can leave too
+		return w.leave(update)
+	}
+
+	if dead {
+		// Whatever it is, it came from beyond the grave
+		return Outcome{}
+	}
+
+	if update.Kind != clientlib.DAMAGE {
+		// Damage is about a player, not from it
+		w.seen[update.PlayerID] = update.Time
+	}
+	if w.Phase(update.Time) == Countdown {
+		// Just in time to play
+		w.match.participants[update.PlayerID] = true
+	}
+
+	switch update.Kind {
+	case clientlib.POSITION:
+		w.positions[update.PlayerID] = update.Pos
+	case clientlib.START:
+		return Outcome{Counted: w.commitStart(update)}
+	case clientlib.PICKUP:
+		return Outcome{Counted: w.commitPickup(update)}
+	case clientlib.DAMAGE:
+		if update.OtherPlayer == 0 && w.Phase(update.Time) != Running {
+			// The zone only hurts during a match
+			return Outcome{}
+		}
+
+		if update.OtherPlayer != 0 && !w.spend(update.Ref, update.Time) {
+			// Bullets only hit once, so this one already hit someone else first
+			return Outcome{}
+		}
+
+		if !w.playing(update.PlayerID, update.Time) ||
+			(update.OtherPlayer != 0 && !w.playing(update.OtherPlayer, update.Time)) {
+			// Spectators can't hurt or be hurt
+			return Outcome{}
+		}
+
+		if w.Invulnerable(update.PlayerID, update.Time) {
+			return Outcome{}
+		}
+
+		w.health[update.PlayerID] = w.Health(update.PlayerID) - update.Damage
+		if w.health[update.PlayerID] <= 0 {
+			return w.kill(update)
+		}
+	}
+
+	return Outcome{Counted: true}
+}
+
+func (w *World) kill(update clientlib.Update) Outcome {
+	w.Fallen[update.PlayerID] = update.Time
+	delete(w.health, update.PlayerID)
+	delete(w.positions, update.PlayerID)
+	delete(w.boosted, update.PlayerID)
+	delete(w.shielded, update.PlayerID)
+
+	if update.PlayerID == w.Local.ID {
+		w.Alive = false
+	} else {
+		w.removePlayer(update.PlayerID)
+	}
+
+	outcome := Outcome{Counted: true, Died: true}
+	if update.Kind == clientlib.DAMAGE {
+		outcome.Bullet = update.Ref
+	}
+	if _, dead := w.Fallen[update.OtherPlayer]; !dead && update.OtherPlayer != 0 && update.OtherPlayer != update.PlayerID {
+		outcome.Killer = update.OtherPlayer
+	}
+
+	if w.checkWinner(update.Time) {
+		outcome.Finished = true
+		outcome.Winner = w.match.winner
+	}
+
+	return outcome
+}
+
+// Players that leave are out of the match, but not dead: they can join again
+// under the same ID, and start afresh like any new player
+func (w *World) leave(update clientlib.Update) Outcome {
+	id := update.PlayerID
+
+	delete(w.Fallen, id)
+	delete(w.health, id)
+	delete(w.spawned, id)
+	delete(w.positions, id)
+	delete(w.boosted, id)
+	delete(w.shielded, id)
+	delete(w.seen, id)
+	delete(w.match.participants, id)
+
+	if id == w.Local.ID {
+		w.Alive = false
+	} else {
+		w.removePlayer(id)
+		w.left[id] = update.Time
+	}
+
+	outcome := Outcome{Counted: true, Left: true}
+	if w.checkWinner(update.Time) {
+		outcome.Finished = true
+		outcome.Winner = w.match.winner
+	}
+
+	return outcome
+}
+
+func (w *World) revive(update clientlib.Update) {
+	delete(w.Fallen, update.PlayerID)
+	w.health[update.PlayerID] = MaxHealth
+	w.spawned[update.PlayerID] = update.Time
+	w.positions[update.PlayerID] = update.Pos
+
+	w.seen[update.PlayerID] = update.Time
+	if w.Phase(update.Time) == Countdown {
+		w.match.participants[update.PlayerID] = true
+	}
+
+	if update.PlayerID == w.Local.ID {
+		w.Alive = true
+		w.respawning = false
+		w.pending = nil
+		w.rearm()
+		w.Local.Pos = update.Pos
+		w.Local.Shown = update.Pos
+
+		// Tell everyone where we are straight away
+		w.lastPositionSent = time.Time{}
+		return
+	}
+
+	if w.Players[update.PlayerID] == nil {
+		w.PlayerIDs = append(w.PlayerIDs, update.PlayerID)
+	}
+
+	// Start smoothing afresh from the spawn point
+	player := NewRemotePlayer(update.PlayerID)
+	player.Accept(clientlib.Update{Kind: clientlib.POSITION, PlayerID: update.PlayerID, Pos: update.Pos, Time: update.Time})
+	w.Players[update.PlayerID] = player
+}
+
+func (w *World) removePlayer(id uint64) {
+	delete(w.Players, id)
+
+	for i, other := range w.PlayerIDs {
+		if other == id {
+			w.PlayerIDs = append(w.PlayerIDs[:i], w.PlayerIDs[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package worldlib
+
+import (
+	"../clientlib"
+	"github.com/faiface/pixel"
+	"testing"
+	"time"
+)
+
+var start = time.Unix(1000, 0)
+
+// Ticks the world every 50ms from from until until, and returns the updates it
+// produced
+func tickUntil(w *World, input Input, from time.Time, until time.Time) []clientlib.Update {
+	var out []clientlib.Update
+
+	const dt = 50 * time.Millisecond
+	for now := from.Add(dt); !now.After(until); now = now.Add(dt) {
+		out = append(out, w.Tick(dt.Seconds(), input, now)...)
+	}
+
+	return out
+}
+
+func hitsOn(updates []clientlib.Update, victim uint64) []clientlib.Update {
+	var hits []clientlib.Update
+	for _, update := range updates {
+		if update.Kind == clientlib.HIT && update.OtherPlayer == victim {
+			hits = append(hits, update)
+		}
+	}
+	return hits
+}
+
+func moveTo(id uint64, pos pixel.Vec, t time.Time) clientlib.Update {
+	return clientlib.Update{Kind: clientlib.POSITION, PlayerID: id, Pos: pos}.Timestamp(t)
+}
+
+func TestRemoteBulletHitsLocalPlayer(t *testing.T) {
+	w := NewWorld(1, EmptyMap())
+
+	shot := clientlib.FireBullet(2, w.Local.Pos.Sub(pixel.V(100, 0)), 0, Cannon).Timestamp(start)
+	w.Accept(shot, start)
+
+	hits := hitsOn(tickUntil(w, Input{}, start, start.Add(time.Second)), 1)
+	if len(hits) != 1 {
+		t.Fatalf("Expected one hit claim on the local player, got %d", len(hits))
+	}
+	if hits[0].PlayerID != 1 || hits[0].Ref != shot.Nonce {
+		t.Errorf("Hit claim %+v isn't ours about the shot", hits[0])
+	}
+	if len(w.Bullets) != 0 {
+		t.Errorf("Bullet is still flying after it hit")
+	}
+}
+
+func TestLocalBulletHitsRemotePlayer(t *testing.T) {
+	w := NewWorld(1, EmptyMap())
+	w.Accept(moveTo(2, w.Local.Pos.Add(pixel.V(100, 0)), start), start)
+
+	out := w.Tick(0, Input{Fire: true}, start)
+	var shot clientlib.Update
+	for _, update := range out {
+		if update.Kind == clientlib.FIRE {
+			shot = update
+		}
+	}
+	if shot.Kind != clientlib.FIRE {
+		t.Fatalf("Expected a FIRE update, got %+v", out)
+	}
+
+	hits := hitsOn(tickUntil(w, Input{}, start, start.Add(time.Second)), 2)
+	if len(hits) != 1 || hits[0].Ref != shot.Nonce {
+		t.Fatalf("Expected one hit claim on the remote player, got %+v", hits)
+	}
+}
+
+func TestWallsStopBullets(t *testing.T) {
+	m, err := ParseMap([]byte("rect 1000 0 1010 3000\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := NewWorld(1, m)
+	w.Local.Pos = pixel.V(1100, 500)
+	w.Accept(clientlib.FireBullet(2, pixel.V(900, 500), 0, Cannon).Timestamp(start), start)
+
+	if hits := hitsOn(tickUntil(w, Input{}, start, start.Add(2*time.Second)), 1); len(hits) != 0 {
+		t.Errorf("Bullet went through a wall: %+v", hits)
+	}
+	if len(w.Bullets) != 0 {
+		t.Errorf("Bullet is still flying after hitting a wall")
+	}
+}
+
+func TestDamageKills(t *testing.T) {
+	w := NewWorld(1, EmptyMap())
+	w.Accept(moveTo(2, pixel.V(100, 100), start), start)
+
+	damage := Weapons[Cannon].Damage
+	for i := 1; i <= MaxHealth/damage; i++ {
+		outcome := w.Commit(clientlib.DamagePlayer(2, 1, uint64(i), damage).Timestamp(start.Add(time.Duration(i) * time.Second)))
+		if !outcome.Counted {
+			t.Fatalf("Hit %d didn't count", i)
+		}
+
+		if i < MaxHealth/damage {
+			if outcome.Died || w.Health(2) != MaxHealth-i*damage {
+				t.Fatalf("After %d hits, health is %d", i, w.Health(2))
+			}
+			continue
+		}
+
+		if !outcome.Died || outcome.Killer != 1 || outcome.Bullet != uint64(i) {
+			t.Fatalf("Last hit should have killed, got %+v", outcome)
+		}
+	}
+
+	if _, ok := w.Players[2]; ok {
+		t.Errorf("Dead player is still around")
+	}
+	if w.Health(2) != 0 {
+		t.Errorf("Dead player has %d health", w.Health(2))
+	}
+
+	// Stragglers from before it died don't bring it back
+	w.Accept(moveTo(2, pixel.V(200, 200), start), start.Add(5*time.Second))
+	if _, ok := w.Players[2]; ok {
+		t.Errorf("Dead player came back from a position update")
+	}
+}
+
+func TestBulletsOnlyHitOnce(t *testing.T) {
+	w := NewWorld(1, EmptyMap())
+
+	first := w.Commit(clientlib.DamagePlayer(2, 1, 42, 10).Timestamp(start))
+	second := w.Commit(clientlib.DamagePlayer(3, 1, 42, 10).Timestamp(start.Add(time.Millisecond)))
+
+	if !first.Counted || second.Counted {
+		t.Errorf("Expected only the first hit to count, got %+v and %+v", first, second)
+	}
+	if w.Health(2) != MaxHealth-10 || w.Health(3) != MaxHealth {
+		t.Errorf("Expected only player 2 hurt, health is %d and %d", w.Health(2), w.Health(3))
+	}
+}
+
+func TestDeadPlayersCantHurt(t *testing.T) {
+	w := NewWorld(1, EmptyMap())
+
+	if outcome := w.Commit(clientlib.DamagePlayer(2, 3, 1, MaxHealth).Timestamp(start)); !outcome.Died {
+		t.Fatalf("Damage didn't kill, got %+v", outcome)
+	}
+
+	// Player 2 is already dead, so can't be hurt or do anything
+	if outcome := w.Commit(clientlib.DamagePlayer(2, 3, 7, 10).Timestamp(start.Add(time.Second))); outcome.Counted {
+		t.Errorf("Damage to a dead player counted")
+	}
+	if outcome := w.Commit(clientlib.StartMatch(2).Timestamp(start.Add(time.Second))); outcome.Counted {
+		t.Errorf("Dead player started a match")
+	}
+}
+
+func TestLocalDeathAndRespawn(t *testing.T) {
+	w := NewWorld(1, EmptyMap())
+
+	w.Commit(clientlib.DamagePlayer(1, 2, 1, MaxHealth).Timestamp(start))
+	if w.Alive {
+		t.Fatalf("Local player is still alive after dying")
+	}
+
+	out := tickUntil(w, Input{}, start, start.Add(RespawnDelay+time.Second))
+	var respawn clientlib.Update
+	for _, update := range out {
+		if update.Kind == clientlib.RESPAWN {
+			respawn = update
+		}
+	}
+	if respawn.Kind != clientlib.RESPAWN {
+		t.Fatalf("Expected a RESPAWN, got %+v", out)
+	}
+	if respawn.Time.Sub(start) < RespawnDelay {
+		t.Errorf("Respawned after %v, before the respawn delay", respawn.Time.Sub(start))
+	}
+
+	if outcome := w.Commit(respawn); !outcome.Counted || !w.Alive || w.Health(1) != MaxHealth {
+		t.Errorf("Respawn didn't bring us back, got %+v", outcome)
+	}
+	if w.Local.Pos != respawn.Pos {
+		t.Errorf("Respawned at %v, not %v", w.Local.Pos, respawn.Pos)
+	}
+}
+
+func TestFastBulletsDontSkipPlayers(t *testing.T) {
+	w := NewWorld(1, EmptyMap())
+	target := w.Local.Pos.Add(pixel.V(0, 300))
+
+	// The target's position and the shot both take 300ms to reach us
+	lag := 300 * time.Millisecond
+	w.Accept(moveTo(2, target, start), start.Add(lag))
+	w.Accept(clientlib.FireBullet(3, target.Sub(pixel.V(370, 0)), 0, Rifle).Timestamp(start), start.Add(lag))
+
+	// Slow frames, where the bullet moves further than a tank is wide
+	const dt = 200 * time.Millisecond
+	var out []clientlib.Update
+	for now := start.Add(lag + dt); now.Before(start.Add(3 * time.Second)); now = now.Add(dt) {
+		out = append(out, w.Tick(dt.Seconds(), Input{}, now)...)
+	}
+
+	hits := hitsOn(out, 2)
+	if len(hits) != 1 {
+		t.Fatalf("Expected one hit claim on the target, got %+v", hits)
+	}
+	if hits[0].Time.After(start.Add(time.Second)) {
+		t.Errorf("Hit claimed at %v, not rewound to when the bullet got there", hits[0].Time.Sub(start))
+	}
+}
+
+func TestMatchUpdates(t *testing.T) {
+	w := NewWorld(1, EmptyMap())
+	w.Commit(moveTo(1, w.Bounds.Center(), start))
+	w.Commit(moveTo(2, w.Bounds.Min.Sub(pixel.V(1000, 1000)), start))
+
+	if outcome := w.Commit(clientlib.StartMatch(1).Timestamp(start)); !outcome.Counted {
+		t.Fatalf("START didn't count")
+	}
+
+	began := start.Add(CountdownDuration)
+	if damage := w.MatchUpdates(began); len(damage) != 0 {
+		t.Fatalf("Zone hurt before the match was a second old: %+v", damage)
+	}
+
+	damage := w.MatchUpdates(began.Add(2*ZoneDamageInterval + ZoneDamageInterval/2))
+	if len(damage) != 2 {
+		t.Fatalf("Expected two hits from the zone, got %+v", damage)
+	}
+	for _, update := range damage {
+		if update.PlayerID != 2 {
+			t.Errorf("Zone hurt player %d, who is inside it", update.PlayerID)
+		}
+		w.Commit(update)
+	}
+	if w.Health(2) != MaxHealth-2*ZoneDamage {
+		t.Errorf("Expected the zone to take %d health, have %d", 2*ZoneDamage, w.Health(2))
+	}
+
+	// Each tick only hurts once
+	if damage := w.MatchUpdates(began.Add(2 * ZoneDamageInterval)); len(damage) != 0 {
+		t.Errorf("Zone hurt again for the same tick: %+v", damage)
+	}
+}
+
+func TestLeaveAndRejoin(t *testing.T) {
+	w := NewWorld(1, EmptyMap())
+	w.Accept(moveTo(2, pixel.V(100, 100), start), start)
+	w.Commit(clientlib.DamagePlayer(2, 3, 1, 10).Timestamp(start))
+
+	leave := clientlib.DeadPlayer(2, 0).Timestamp(start.Add(time.Second))
+	w.Accept(leave, leave.Time)
+	if outcome := w.Commit(leave); !outcome.Counted || !outcome.Left || outcome.Died {
+		t.Fatalf("Expected leaving to count as leaving, got %+v", outcome)
+	}
+	if _, ok := w.Players[2]; ok {
+		t.Fatalf("Player is still around after leaving")
+	}
+
+	// Stragglers from before it left don't bring it back
+	w.Accept(moveTo(2, pixel.V(200, 200), start.Add(time.Second/2)), start.Add(2*time.Second))
+	if _, ok := w.Players[2]; ok {
+		t.Errorf("Player came back from a position sent before it left")
+	}
+
+	// But it can join again under the same ID, afresh
+	back := moveTo(2, pixel.V(300, 300), start.Add(5*time.Second))
+	w.Accept(back, back.Time)
+	if _, ok := w.Players[2]; !ok {
+		t.Fatalf("Player didn't come back after rejoining")
+	}
+	if outcome := w.Commit(back); !outcome.Counted {
+		t.Errorf("Rejoined player's update didn't count")
+	}
+	if w.Health(2) != MaxHealth {
+		t.Errorf("Rejoined player has %d health", w.Health(2))
+	}
+
+	// Even if it was dead when it left
+	w.Commit(clientlib.DamagePlayer(2, 3, 2, MaxHealth).Timestamp(start.Add(6 * time.Second)))
+	w.Commit(clientlib.DeadPlayer(2, 0).Timestamp(start.Add(7 * time.Second)))
+	again := moveTo(2, pixel.V(300, 300), start.Add(8*time.Second))
+	w.Accept(again, again.Time)
+	if _, ok := w.Players[2]; !ok || !w.Commit(again).Counted {
+		t.Errorf("Player who left dead couldn't rejoin")
+	}
+}
+
+func TestQuietPlayersLeaveTheMatch(t *testing.T) {
+	w := NewWorld(1, EmptyMap())
+	w.Commit(moveTo(1, w.Bounds.Center(), start))
+	w.Commit(moveTo(2, w.Bounds.Center(), start))
+	w.Commit(clientlib.StartMatch(1).Timestamp(start))
+
+	// Player 1 keeps saying where it is, player 2 has crashed
+	began := start.Add(CountdownDuration)
+	var outcome Outcome
+	for now := start; now.Before(began.Add(2 * SilentTimeout)); now = now.Add(time.Second) {
+		for _, due := range w.MatchUpdates(now) {
+			if o := w.Commit(due); o.Finished {
+				outcome = o
+			}
+		}
+		w.Commit(moveTo(1, w.Bounds.Center(), now))
+	}
+
+	if !outcome.Finished || outcome.Winner != 1 {
+		t.Fatalf("Expected player 1 to win once player 2 went quiet, got %+v", outcome)
+	}
+	if w.Phase(began.Add(SilentTimeout)) == Running {
+		t.Errorf("Match still running after player 2 went quiet")
+	}
+}